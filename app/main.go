@@ -1,18 +1,24 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/golang/glog"
-	"gopkg.in/yaml.v2"
 
+	"github.com/k8s-storage/dumbledore/pkg/certs"
+	policyclient "github.com/k8s-storage/dumbledore/pkg/client/v1alpha1"
 	"github.com/k8s-storage/dumbledore/pkg/controller"
+	"github.com/k8s-storage/dumbledore/pkg/leaderelection"
+	"github.com/k8s-storage/dumbledore/pkg/metrics"
+	"github.com/k8s-storage/dumbledore/pkg/webhook"
 
-	coreV1 "k8s.io/api/core/v1"
-	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -23,22 +29,91 @@ const (
 	defaultInitializerName    = "pv.initializer.kubernetes.io"
 	defaultConfigmapName      = "pv-initializer"
 	defaultConfigMapNamespace = "default"
+	defaultExcludedNamespaces = "kube-system,kube-public,kube-node-lease"
+	defaultWebhookAddress     = ":8443"
+	defaultMetricsAddress     = ":9090"
+	defaultWebhookName        = "pv-initializer"
+	defaultCertSecretName     = "pv-initializer-tls"
+	defaultCertRotateBefore   = 30 * 24 * time.Hour
+	defaultLeaderElectLock    = "pv-initializer-leader"
+
+	modeWebhook     = "webhook"
+	modeInitializer = "initializer"
+
+	configSourceCRD       = "crd"
+	configSourceConfigMap = "configmap"
 )
 
 var (
-	kubeConfig string
-	kubeMaster string
+	kubeConfig     string
+	kubeMaster     string
+	mode           string
+	configSource   string
+	webhookAddress string
+	metricsAddress string
+	tlsCertFile    string
+	tlsKeyFile     string
+	certOptions    certs.Options
+	leaderElect    bool
+	leaderConfig   leaderelection.Config
+	failurePolicy  string
+	claimConflicts string
 )
 
 func main() {
 	flag.StringVar(&controller.PVAnnotation, "pv-annotation", defaultPVAnnotation, "PersistentVolume Annotation to patch")
+	flag.StringVar(&configSource, "config-source", configSourceCRD, "Read the rules from PersistentVolumeAttributePolicy objects (\"crd\") or from the \"configmap\"")
 	flag.StringVar(&controller.IntializerConfigmapName, "configmap", defaultConfigmapName, "storage initializer configuration configmap")
 	flag.StringVar(&controller.InitializerName, "initializer-name", defaultInitializerName, "The initializer name")
 	flag.StringVar(&controller.IntializerNamespace, "namespace", defaultConfigMapNamespace, "The configuration namespace")
+	flag.StringVar(&controller.ExcludedNamespaces, "exclude-namespaces", defaultExcludedNamespaces, "Comma separated list of namespaces whose pods are never touched")
+	flag.StringVar(&controller.KeySecretNamespace, "key-namespace", "", "The namespace of the secrets holding generated keys, defaults to -namespace")
+	flag.StringVar(&controller.DriverProfilesConfigMap, "driver-profiles", "", "The configmap in -namespace declaring the attributes each CSI driver accepts, empty to not validate attributes")
+	flag.StringVar(&controller.SecretValueMode, "secret-values", controller.SecretValuesReference, "Write a \"reference\" to the secret of secret attributes into the PV, or \"resolve\" and write their values")
+	flag.DurationVar(&controller.EnforcementTimeout, "enforcement-timeout", controller.EnforcementTimeout, "How long pods matched by strict or fail-closed rules wait for the attributes, must be shorter than the webhook timeout")
+	flag.StringVar(&failurePolicy, "enforcement-failure-policy", string(controller.FailClosed), "The failure policy of strict rules without one: reject (\"fail-closed\") or admit (\"fail-open\") pods whose attributes are not applied in time")
+	flag.StringVar(&claimConflicts, "claim-conflicts", string(controller.ClaimConflictCondition), "How conflicting attributes of pods sharing a claim are handled: \"reject\" the pod admitted later, \"keep-stricter\" value, or apply the later value and raise a \"condition\"")
 	flag.StringVar(&kubeConfig, "kubeconfig", "", "Absolute path to the kubeconfig")
 	flag.StringVar(&kubeMaster, "kubemaster", "", "Kubernetes Controller Master URL")
+	flag.StringVar(&mode, "mode", modeWebhook, "Run as a mutating admission \"webhook\" or as a legacy pod \"initializer\"")
+	flag.StringVar(&webhookAddress, "webhook-address", defaultWebhookAddress, "The address the admission webhook listens on")
+	flag.StringVar(&metricsAddress, "metrics-address", defaultMetricsAddress, "The address /metrics is served on, empty to disable")
+	flag.StringVar(&tlsCertFile, "tls-cert-file", "", "The webhook serving certificate")
+	flag.StringVar(&tlsKeyFile, "tls-private-key-file", "", "The webhook serving private key")
+	flag.StringVar(&certOptions.SecretName, "cert-secret", defaultCertSecretName, "The secret to store the generated webhook certificates in, used when no -tls-cert-file is given")
+	flag.StringVar(&certOptions.ServiceName, "webhook-service", defaultWebhookName, "The service the generated webhook certificate is issued for")
+	flag.StringVar(&certOptions.WebhookConfigName, "webhook-configuration", defaultWebhookName, "The MutatingWebhookConfiguration to keep the caBundle of up to date")
+	flag.DurationVar(&certOptions.RotateBefore, "cert-rotate-before", defaultCertRotateBefore, "How long before expiry the generated webhook certificate is rotated")
+	flag.BoolVar(&leaderElect, "leader-elect", true, "Elect a leader among the replicas, only the leader updates PVs")
+	flag.StringVar(&leaderConfig.Name, "leader-elect-lock", defaultLeaderElectLock, "The Lease holding the leader lock")
+	flag.DurationVar(&leaderConfig.LeaseDuration, "leader-elect-lease-duration", 15*time.Second, "How long the other replicas wait before they take over from a leader that stopped renewing")
+	flag.DurationVar(&leaderConfig.RenewDeadline, "leader-elect-renew-deadline", 10*time.Second, "How long the leader retries to renew before it gives up leadership")
+	flag.DurationVar(&leaderConfig.RetryPeriod, "leader-elect-retry-period", 2*time.Second, "The interval of the attempts to acquire or renew leadership")
 	flag.Parse()
 	flag.Set("logtostderr", "true")
+	if len(controller.KeySecretNamespace) == 0 {
+		controller.KeySecretNamespace = controller.IntializerNamespace
+	}
+
+	if mode != modeWebhook && mode != modeInitializer {
+		glog.Fatalf("unknown mode %q", mode)
+	}
+	if controller.SecretValueMode != controller.SecretValuesReference && controller.SecretValueMode != controller.SecretValuesResolve {
+		glog.Fatalf("unknown secret values mode %q", controller.SecretValueMode)
+	}
+	controller.EnforcementFailurePolicy = controller.FailurePolicy(failurePolicy)
+	if controller.EnforcementFailurePolicy != controller.FailOpen && controller.EnforcementFailurePolicy != controller.FailClosed {
+		glog.Fatalf("unknown enforcement failure policy %q", failurePolicy)
+	}
+	controller.ClaimConflicts = controller.ClaimConflictStrategy(claimConflicts)
+	switch controller.ClaimConflicts {
+	case controller.ClaimConflictReject, controller.ClaimConflictKeepStricter, controller.ClaimConflictCondition:
+	default:
+		glog.Fatalf("unknown claim conflict strategy %q", claimConflicts)
+	}
+	if configSource != configSourceCRD && configSource != configSourceConfigMap {
+		glog.Fatalf("unknown config source %q", configSource)
+	}
 
 	var clusterConfig *rest.Config
 	var err error
@@ -57,35 +132,127 @@ func main() {
 		glog.Fatal(err)
 	}
 
-	cm, err := clientset.CoreV1().ConfigMaps(controller.IntializerNamespace).Get(controller.IntializerConfigmapName, metaV1.GetOptions{})
+	policyClient, err := policyclient.NewForConfig(clusterConfig)
 	if err != nil {
 		glog.Fatal(err)
 	}
-	conf, err := configMapToConfig(cm)
-	if err != nil {
-		glog.Fatalf("failed to parse configmap: %v", err)
+
+	var ctrl *controller.Controller
+	if mode == modeInitializer {
+		ctrl = controller.NewPVInitializer(clientset)
+	} else {
+		ctrl = controller.NewPVController(clientset)
 	}
-	ctrl := controller.NewPVInitializer(clientset, conf)
 	if ctrl == nil {
 		glog.Fatal("failed to create initializer")
 	}
-	glog.Infof("Starting initializer ")
+
+	var configWatcher *controller.ConfigWatcher
+	if configSource == configSourceConfigMap {
+		configWatcher = controller.NewConfigMapWatcher(clientset, ctrl)
+	} else {
+		configWatcher = controller.NewPolicyWatcher(policyClient, ctrl)
+	}
+	if len(metricsAddress) > 0 {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+		go func() {
+			glog.Infof("metrics listening on %s", metricsAddress)
+			if err := http.ListenAndServe(metricsAddress, mux); err != nil {
+				glog.Fatalf("metrics server failed: %v", err)
+			}
+		}()
+	}
+
 	stop := make(chan struct{})
-	go ctrl.Run(stop)
+	if len(controller.DriverProfilesConfigMap) > 0 {
+		profileWatcher := controller.NewProfileWatcher(clientset, ctrl)
+		go profileWatcher.Run(stop)
+		glog.Infof("Waiting for driver profiles")
+		// the rules are validated against the profiles when they are loaded.
+		err = wait.Poll(time.Second, 5*time.Minute, func() (bool, error) {
+			return profileWatcher.HasSynced(), nil
+		})
+		if err != nil {
+			glog.Fatalf("failed to read driver profiles: %v", err)
+		}
+	}
+	go configWatcher.Run(stop)
+	glog.Infof("Waiting for %s rules", configSource)
+	// admit no pods before the rules are known.
+	err = wait.Poll(time.Second, 5*time.Minute, func() (bool, error) {
+		return configWatcher.HasSynced(), nil
+	})
+	if err != nil {
+		glog.Fatalf("failed to read rules: %v", err)
+	}
+
+	// only the leader updates pods, PVs and the policy status; all replicas
+	// serve the webhook.
+	lead := func(stop <-chan struct{}) {
+		glog.Infof("Starting %s", mode)
+		if configSource == configSourceCRD {
+			go controller.NewPolicyStatusUpdater(clientset, policyClient, ctrl).Run(stop)
+		}
+		ctrl.Run(stop)
+	}
+	done := make(chan struct{})
+	if leaderElect {
+		leaderConfig.Namespace = controller.IntializerNamespace
+		leaderConfig.Identity, err = os.Hostname()
+		if err != nil {
+			glog.Fatal(err)
+		}
+		leaderConfig.OnStartedLeading = lead
+		leaderConfig.OnStoppedLeading = func() {
+			select {
+			case <-stop:
+			default:
+				// the controller can't be restarted, start over.
+				glog.Fatalf("lost leadership")
+			}
+		}
+		go func() {
+			defer close(done)
+			if err := leaderelection.Run(clientset, ctrl.Recorder(), leaderConfig, stop); err != nil {
+				glog.Fatalf("failed to elect a leader: %v", err)
+			}
+		}()
+	} else {
+		go func() {
+			defer close(done)
+			lead(stop)
+		}()
+	}
+
+	if mode == modeWebhook {
+		server := &http.Server{
+			Addr:    webhookAddress,
+			Handler: webhook.NewServer(ctrl).Handler(),
+		}
+		if len(tlsCertFile) == 0 {
+			// no certificate given, generate and rotate our own.
+			certOptions.SecretNamespace = controller.IntializerNamespace
+			certManager := certs.NewManager(clientset, certOptions)
+			if err := certManager.Bootstrap(); err != nil {
+				glog.Fatalf("failed to bootstrap webhook certificate: %v", err)
+			}
+			go certManager.Run(stop)
+			server.TLSConfig = &tls.Config{GetCertificate: certManager.GetCertificate}
+		}
+		go func() {
+			glog.Infof("webhook listening on %s", webhookAddress)
+			if err := server.ListenAndServeTLS(tlsCertFile, tlsKeyFile); err != nil && err != http.ErrServerClosed {
+				glog.Fatalf("webhook server failed: %v", err)
+			}
+		}()
+	}
 
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
 	<-signalChan
 
 	close(stop)
-}
-
-func configMapToConfig(cm *coreV1.ConfigMap) (*[]controller.Config, error) {
-	var c []controller.Config
-	err := yaml.Unmarshal([]byte(cm.Data["config"]), &c)
-	if err != nil {
-		return nil, err
-	}
-	glog.V(5).Infof("configs %+v", c)
-	return &c, err
+	// wait for the pending attributes to be handed over.
+	<-done
 }
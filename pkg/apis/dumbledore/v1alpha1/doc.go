@@ -0,0 +1,4 @@
+// Package v1alpha1 contains the PersistentVolumeAttributePolicy API.
+// +k8s:deepcopy-gen=package
+// +groupName=dumbledore.k8s-storage.io
+package v1alpha1
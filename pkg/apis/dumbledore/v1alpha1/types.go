@@ -0,0 +1,229 @@
+package v1alpha1
+
+import (
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// +genclient
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// PersistentVolumeAttributePolicy sets CSI volume attributes on the PVs used
+// by the matching pods of its own namespace. Attributes set by a matching
+// ClusterPersistentVolumeAttributePolicy take precedence.
+type PersistentVolumeAttributePolicy struct {
+	metaV1.TypeMeta   `json:",inline"`
+	metaV1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   PersistentVolumeAttributePolicySpec   `json:"spec"`
+	Status PersistentVolumeAttributePolicyStatus `json:"status,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// PersistentVolumeAttributePolicyList is a list of PersistentVolumeAttributePolicy objects.
+type PersistentVolumeAttributePolicyList struct {
+	metaV1.TypeMeta `json:",inline"`
+	metaV1.ListMeta `json:"metadata,omitempty"`
+
+	Items []PersistentVolumeAttributePolicy `json:"items"`
+}
+
+// +genclient
+// +genclient:nonNamespaced
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// ClusterPersistentVolumeAttributePolicy sets CSI volume attributes on the PVs
+// used by the matching pods of all namespaces.
+type ClusterPersistentVolumeAttributePolicy struct {
+	metaV1.TypeMeta   `json:",inline"`
+	metaV1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   PersistentVolumeAttributePolicySpec   `json:"spec"`
+	Status PersistentVolumeAttributePolicyStatus `json:"status,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// ClusterPersistentVolumeAttributePolicyList is a list of ClusterPersistentVolumeAttributePolicy objects.
+type ClusterPersistentVolumeAttributePolicyList struct {
+	metaV1.TypeMeta `json:",inline"`
+	metaV1.ListMeta `json:"metadata,omitempty"`
+
+	Items []ClusterPersistentVolumeAttributePolicy `json:"items"`
+}
+
+type PersistentVolumeAttributePolicySpec struct {
+	// Label is the value of the pod's app label the policy applies to.
+	// It is a shorthand for a Selector and cannot be used together with it.
+	// +optional
+	Label string `json:"label,omitempty"`
+	// Selector is matched against the labels of the pods the policy applies to.
+	// +optional
+	Selector *metaV1.LabelSelector `json:"selector,omitempty"`
+	// NamespaceSelector is matched against the labels of the pod's namespace.
+	// Only supported by ClusterPersistentVolumeAttributePolicy.
+	// +optional
+	NamespaceSelector *metaV1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// Attributes are the CSI volume attributes set on the PVs, as a JSON
+	// Merge Patch: objects are merged into those on the PV and null removes
+	// an attribute.
+	// +optional
+	Attributes map[string]runtime.RawExtension `json:"attributes,omitempty"`
+	// GeneratedKeys are attributes set to a random key generated for every
+	// PV. The key is stored in a Secret owned by the PV, the attribute is set
+	// to a reference to the Secret.
+	// +optional
+	GeneratedKeys []GeneratedKey `json:"generatedKeys,omitempty"`
+	// SecretAttributes are attributes read from Secrets. Namespaced policies
+	// can only refer to Secrets in their own namespace.
+	// +optional
+	SecretAttributes []SecretAttribute `json:"secretAttributes,omitempty"`
+	// Sensitive lists attributes whose values are redacted in logs, events
+	// and status. Secret attributes are always sensitive.
+	// +optional
+	Sensitive []string `json:"sensitive,omitempty"`
+	// Priority orders the policies matching a pod, policies with a higher
+	// priority are merged later. Namespaced policies are always merged
+	// before cluster policies.
+	// +optional
+	Priority int32 `json:"priority,omitempty"`
+	// MergeStrategy decides what happens to attributes already set by a
+	// policy merged earlier or on the PV: "override" (default),
+	// "keep-existing" or "fail-on-conflict".
+	// +optional
+	MergeStrategy string `json:"mergeStrategy,omitempty"`
+	// Enforcement decides whether the matching pods are admitted right away,
+	// "best-effort" (default), or only once the PVs of their claims carry
+	// the attributes, "strict".
+	// +optional
+	Enforcement string `json:"enforcement,omitempty"`
+	// FailurePolicy decides whether the matching pods are admitted if the
+	// attributes can't be applied, "fail-open", or rejected, "fail-closed".
+	// Defaults to fail-open, or to the controller's
+	// -enforcement-failure-policy for strict policies.
+	// +optional
+	FailurePolicy string `json:"failurePolicy,omitempty"`
+	// Monotonic are attributes whose values may only move forward in an
+	// order, on the PVs of all pods. Namespaced policies only protect the
+	// PVs of their own namespace.
+	// +optional
+	Monotonic []MonotonicAttribute `json:"monotonic,omitempty"`
+	// Immutable are attributes that can't change once set on a PV.
+	// +optional
+	Immutable []string `json:"immutable,omitempty"`
+	// JSONPatch are JSON Patch operations applied to the attributes of the
+	// PVs after the attributes are merged.
+	// +optional
+	JSONPatch []PatchOperation `json:"jsonPatch,omitempty"`
+	// Target decides where the attributes are written: into the PV
+	// annotation, "annotation" (default), into spec.csi.volumeAttributes,
+	// "spec", or into both, "both". The spec can only be written before the
+	// PV is bound.
+	// +optional
+	Target string `json:"target,omitempty"`
+	// Drivers restricts the policy to CSI volumes of these drivers.
+	// +optional
+	Drivers []string `json:"drivers,omitempty"`
+	// StorageClasses restricts the policy to volumes of these storage
+	// classes.
+	// +optional
+	StorageClasses []string `json:"storageClasses,omitempty"`
+	// StorageClassSelector restricts the policy to volumes of storage
+	// classes matching it.
+	// +optional
+	StorageClassSelector *metaV1.LabelSelector `json:"storageClassSelector,omitempty"`
+	// Claim sets the storage class and annotations of the matching claims
+	// when they are created, before their volumes are provisioned.
+	// +optional
+	Claim *ClaimMutation `json:"claim,omitempty"`
+}
+
+type ClaimMutation struct {
+	// Selector is matched against the claim's labels. Without one, the
+	// policy's selector is matched against the labels of the claim and of
+	// the pods of the workload owning it.
+	// +optional
+	Selector *metaV1.LabelSelector `json:"selector,omitempty"`
+	// StorageClassName is set on claims that request no storage class or
+	// the default one.
+	// +optional
+	StorageClassName string `json:"storageClassName,omitempty"`
+	// Annotations are set on the claim, e.g. for the provisioner.
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type PatchOperation struct {
+	// Op is add, remove, replace, move, copy or test.
+	Op string `json:"op"`
+	// Path is a JSON pointer into the attributes.
+	Path string `json:"path"`
+	// From is the source of move and copy.
+	// +optional
+	From string `json:"from,omitempty"`
+	// Value is the value of add, replace and test.
+	// +optional
+	Value runtime.RawExtension `json:"value,omitempty"`
+}
+
+type MonotonicAttribute struct {
+	// Attribute is the name of the attribute.
+	Attribute string `json:"attribute"`
+	// Values are the values of the attribute in the order they may change
+	// in, values that are not listed come first.
+	Values []string `json:"values"`
+}
+
+type GeneratedKey struct {
+	// Attribute is the name of the attribute.
+	Attribute string `json:"attribute"`
+	// Length is the length of the key in bytes, 32 by default.
+	// +optional
+	Length int32 `json:"length,omitempty"`
+}
+
+type SecretAttribute struct {
+	// Attribute is the name of the attribute.
+	Attribute    string            `json:"attribute"`
+	SecretKeyRef SecretKeySelector `json:"secretKeyRef"`
+}
+
+type SecretKeySelector struct {
+	// Namespace defaults to the namespace of the policy, or to the
+	// controller's namespace for cluster policies.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	Key       string `json:"key"`
+}
+
+type PersistentVolumeAttributePolicyStatus struct {
+	// ObservedGeneration is the generation of the spec the status was computed for.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// PersistentVolumes is the number of PVs the policy is currently applied to.
+	PersistentVolumes int32 `json:"persistentVolumes"`
+	// Conditions are the current conditions of the policy.
+	// +optional
+	Conditions []PolicyCondition `json:"conditions,omitempty"`
+}
+
+// ConditionConflict is true while the attributes of the policy conflict with
+// those of another policy on a PV shared by pods of both.
+const ConditionConflict = "Conflict"
+
+// ConditionInvalid is true while the policy is skipped because it is invalid.
+const ConditionInvalid = "Invalid"
+
+type PolicyCondition struct {
+	Type string `json:"type"`
+	// Status is "True" or "False".
+	Status string `json:"status"`
+	// +optional
+	LastTransitionTime metaV1.Time `json:"lastTransitionTime,omitempty"`
+	// +optional
+	Reason string `json:"reason,omitempty"`
+	// +optional
+	Message string `json:"message,omitempty"`
+}
@@ -0,0 +1,415 @@
+package certs
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	coreV1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/cert"
+)
+
+const (
+	caCertKey = "ca.crt"
+	caKeyKey  = "ca.key"
+	// The CA replacing the current one. It is in the bundle already, but
+	// only signs once the webhook configuration trusts it.
+	nextCACertKey = "next-ca.crt"
+	nextCAKeyKey  = "next-ca.key"
+
+	// The admissionregistration.k8s.io/v1 client is not vendored, the
+	// webhook configuration is patched through the raw REST path.
+	mutatingWebhookConfigPath = "/apis/admissionregistration.k8s.io/v1/mutatingwebhookconfigurations"
+
+	checkInterval = time.Minute
+)
+
+// Options configures where the certificates are stored and who they are for.
+type Options struct {
+	// SecretNamespace and SecretName locate the Secret that holds the CA
+	// and the serving certificate.
+	SecretNamespace string
+	SecretName      string
+	// ServiceName is the Service fronting the webhook. The serving
+	// certificate is issued for its DNS names in SecretNamespace.
+	ServiceName string
+	// WebhookConfigName is the MutatingWebhookConfiguration whose caBundle
+	// is kept in sync with the CA.
+	WebhookConfigName string
+	// RotateBefore is how long before expiry a certificate is renewed.
+	RotateBefore time.Duration
+}
+
+// Manager bootstraps a self-signed CA and serving certificate, keeps them in
+// a Secret shared by all replicas and rotates them before they expire. The
+// current certificate is served through GetCertificate so rotation does not
+// need a restart of the listener.
+type Manager struct {
+	clientset *kubernetes.Clientset
+	opts      Options
+
+	lock        sync.RWMutex
+	certificate *tls.Certificate
+	servingCert *x509.Certificate
+	caCert      *x509.Certificate
+	caKey       *rsa.PrivateKey
+	nextCACert  *x509.Certificate
+	nextCAKey   *rsa.PrivateKey
+	certPEM     []byte
+	caBundle    []byte
+	// published is the last caBundle the webhook configuration was seen
+	// with.
+	published []byte
+}
+
+func NewManager(clientset *kubernetes.Clientset, opts Options) *Manager {
+	return &Manager{
+		clientset: clientset,
+		opts:      opts,
+	}
+}
+
+// Bootstrap loads the certificates from the Secret, generating or renewing
+// them if needed, and makes sure the webhook configuration trusts the CA.
+func (m *Manager) Bootstrap() error {
+	if err := m.sync(); err != nil {
+		return err
+	}
+	return m.patchCABundle()
+}
+
+// Run checks the certificates periodically until stop is closed.
+func (m *Manager) Run(stop <-chan struct{}) {
+	wait.Until(func() {
+		if err := m.sync(); err != nil {
+			glog.Warningf("failed to sync webhook certificate: %v", err)
+			return
+		}
+		if err := m.patchCABundle(); err != nil {
+			glog.Warningf("failed to patch webhook CA bundle: %v", err)
+		}
+	}, checkInterval, stop)
+}
+
+// GetCertificate is meant to be used as tls.Config.GetCertificate.
+func (m *Manager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.certificate == nil {
+		return nil, fmt.Errorf("no serving certificate loaded")
+	}
+	return m.certificate, nil
+}
+
+// sync loads the Secret, renews what is about to expire and stores it back.
+// Another replica may rotate the certificates first, in which case the update
+// conflicts and the new Secret is loaded on the next sync.
+func (m *Manager) sync() error {
+	secrets := m.clientset.CoreV1().Secrets(m.opts.SecretNamespace)
+	secret, err := secrets.Get(m.opts.SecretName, metaV1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		secret = &coreV1.Secret{
+			ObjectMeta: metaV1.ObjectMeta{
+				Name:      m.opts.SecretName,
+				Namespace: m.opts.SecretNamespace,
+			},
+			Type: coreV1.SecretTypeTLS,
+		}
+		if err := m.renew(secret); err != nil {
+			return err
+		}
+		_, err := secrets.Create(secret)
+		if apierrors.IsAlreadyExists(err) {
+			// another replica created it first.
+			if secret, err = secrets.Get(m.opts.SecretName, metaV1.GetOptions{}); err != nil {
+				return err
+			}
+			return m.load(secret)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create secret %s/%s: %v", secret.Namespace, secret.Name, err)
+		}
+		glog.Infof("created webhook certificate secret %s/%s", secret.Namespace, secret.Name)
+		return m.load(secret)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := m.load(secret); err != nil {
+		glog.Warningf("invalid certificate secret %s/%s, regenerating: %v", secret.Namespace, secret.Name, err)
+	} else if !m.needsRenewal() {
+		return nil
+	}
+
+	if err := m.renew(secret); err != nil {
+		return err
+	}
+	if _, err := secrets.Update(secret); err != nil {
+		return fmt.Errorf("failed to update secret %s/%s: %v", secret.Namespace, secret.Name, err)
+	}
+	glog.Infof("rotated webhook certificate in secret %s/%s", secret.Namespace, secret.Name)
+	return m.load(secret)
+}
+
+// load parses the Secret and swaps in its certificate if it has changed.
+func (m *Manager) load(secret *coreV1.Secret) error {
+	certPEM := secret.Data[coreV1.TLSCertKey]
+	keyPEM := secret.Data[coreV1.TLSPrivateKeyKey]
+	caBundle := secret.Data[caCertKey]
+
+	m.lock.RLock()
+	unchanged := m.certificate != nil && bytes.Equal(certPEM, m.certPEM) && bytes.Equal(caBundle, m.caBundle)
+	m.lock.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	servingCert, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return err
+	}
+	caCerts, err := cert.ParseCertsPEM(caBundle)
+	if err != nil {
+		return err
+	}
+	caKey, err := parseKey(secret.Data[caKeyKey])
+	if err != nil {
+		return err
+	}
+	var nextCACert *x509.Certificate
+	var nextCAKey *rsa.PrivateKey
+	if data, ok := secret.Data[nextCACertKey]; ok {
+		nextCACerts, err := cert.ParseCertsPEM(data)
+		if err != nil {
+			return err
+		}
+		if nextCAKey, err = parseKey(secret.Data[nextCAKeyKey]); err != nil {
+			return err
+		}
+		nextCACert = nextCACerts[0]
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.certificate = &certificate
+	m.servingCert = servingCert
+	// The signing CA is always first in the bundle.
+	m.caCert = caCerts[0]
+	m.caKey = caKey
+	m.nextCACert = nextCACert
+	m.nextCAKey = nextCAKey
+	m.certPEM = certPEM
+	m.caBundle = caBundle
+	glog.V(3).Infof("loaded webhook certificate valid until %v", servingCert.NotAfter)
+	return nil
+}
+
+func parseKey(data []byte) (*rsa.PrivateKey, error) {
+	key, err := cert.ParsePrivateKeyPEM(data)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("CA key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+func (m *Manager) needsRenewal() bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	deadline := time.Now().Add(m.opts.RotateBefore)
+	if m.servingCert.NotAfter.Before(deadline) {
+		return true
+	}
+	if m.nextCACert == nil {
+		return m.caCert.NotAfter.Before(deadline)
+	}
+	return m.canPromote()
+}
+
+// canPromote tells whether the next CA can sign: once the webhook
+// configuration trusts it, or once the current CA expired. It must be called
+// with the lock held.
+func (m *Manager) canPromote() bool {
+	return bytes.Equal(m.published, m.caBundle) || m.caCert.NotAfter.Before(time.Now())
+}
+
+// renew issues a new serving certificate into the Secret. A CA that is about
+// to expire is replaced in two steps: the next CA is added to the bundle
+// first, and only signs the serving certificate once the webhook
+// configuration trusts it. The old CA stays in the bundle until it expires so
+// that clients can verify both certificates meanwhile.
+func (m *Manager) renew(secret *coreV1.Secret) error {
+	m.lock.RLock()
+	caCert, caKey, caBundle := m.caCert, m.caKey, m.caBundle
+	nextCACert, nextCAKey := m.nextCACert, m.nextCAKey
+	promote := nextCACert != nil && m.canPromote()
+	m.lock.RUnlock()
+
+	var err error
+	switch {
+	case caCert == nil:
+		// nothing trusts a CA yet, e.g. on the first start.
+		if caCert, caKey, err = m.newCA(); err != nil {
+			return err
+		}
+		nextCACert, nextCAKey = nil, nil
+		caBundle = bundleOf(caCert, caBundle)
+	case promote:
+		glog.Infof("switching the webhook certificate to the next CA")
+		caCert, caKey = nextCACert, nextCAKey
+		nextCACert, nextCAKey = nil, nil
+		caBundle = bundleOf(caCert, caBundle)
+	case nextCACert == nil && caCert.NotAfter.Before(time.Now().Add(m.opts.RotateBefore)):
+		if nextCACert, nextCAKey, err = m.newCA(); err != nil {
+			return err
+		}
+		caBundle = bundleOf(caCert, append(append([]byte(nil), caBundle...), cert.EncodeCertPEM(nextCACert)...))
+	}
+
+	key, err := cert.NewPrivateKey()
+	if err != nil {
+		return err
+	}
+	host := m.opts.ServiceName + "." + m.opts.SecretNamespace + ".svc"
+	servingCert, err := cert.NewSignedCert(cert.Config{
+		CommonName: host,
+		AltNames: cert.AltNames{
+			DNSNames: []string{
+				m.opts.ServiceName,
+				m.opts.ServiceName + "." + m.opts.SecretNamespace,
+				host,
+			},
+		},
+		Usages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, key, caCert, caKey)
+	if err != nil {
+		return err
+	}
+
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+	secret.Data[coreV1.TLSCertKey] = cert.EncodeCertPEM(servingCert)
+	secret.Data[coreV1.TLSPrivateKeyKey] = cert.EncodePrivateKeyPEM(key)
+	secret.Data[caCertKey] = caBundle
+	secret.Data[caKeyKey] = cert.EncodePrivateKeyPEM(caKey)
+	if nextCACert != nil {
+		secret.Data[nextCACertKey] = cert.EncodeCertPEM(nextCACert)
+		secret.Data[nextCAKeyKey] = cert.EncodePrivateKeyPEM(nextCAKey)
+	} else {
+		delete(secret.Data, nextCACertKey)
+		delete(secret.Data, nextCAKeyKey)
+	}
+	return nil
+}
+
+func (m *Manager) newCA() (*x509.Certificate, *rsa.PrivateKey, error) {
+	key, err := cert.NewPrivateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	caCert, err := cert.NewSelfSignedCACert(cert.Config{CommonName: m.opts.ServiceName + "-ca"}, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return caCert, key, nil
+}
+
+// bundleOf returns the PEM bundle of the CA followed by the other
+// certificates of the bundle that are still valid.
+func bundleOf(caCert *x509.Certificate, bundle []byte) []byte {
+	newBundle := cert.EncodeCertPEM(caCert)
+	if certs, err := cert.ParseCertsPEM(bundle); err == nil {
+		for _, c := range certs {
+			if !c.Equal(caCert) && c.NotAfter.After(time.Now()) {
+				newBundle = append(newBundle, cert.EncodeCertPEM(c)...)
+			}
+		}
+	}
+	return newBundle
+}
+
+type webhookConfiguration struct {
+	Webhooks []struct {
+		ClientConfig struct {
+			CABundle []byte `json:"caBundle"`
+		} `json:"clientConfig"`
+	} `json:"webhooks"`
+}
+
+type patchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// patchCABundle sets the caBundle of every webhook in the configuration.
+func (m *Manager) patchCABundle() error {
+	m.lock.RLock()
+	caBundle := m.caBundle
+	m.lock.RUnlock()
+
+	restClient := m.clientset.CoreV1().RESTClient()
+	raw, err := restClient.Get().AbsPath(mutatingWebhookConfigPath, m.opts.WebhookConfigName).Do().Raw()
+	if err != nil {
+		return fmt.Errorf("failed to get webhook configuration %s: %v", m.opts.WebhookConfigName, err)
+	}
+	config := webhookConfiguration{}
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return err
+	}
+
+	var patch []patchOperation
+	for i, hook := range config.Webhooks {
+		if bytes.Equal(hook.ClientConfig.CABundle, caBundle) {
+			continue
+		}
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  fmt.Sprintf("/webhooks/%d/clientConfig/caBundle", i),
+			Value: base64.StdEncoding.EncodeToString(caBundle),
+		})
+	}
+	if len(patch) == 0 {
+		m.setPublished(caBundle)
+		return nil
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	err = restClient.Patch(types.JSONPatchType).AbsPath(mutatingWebhookConfigPath, m.opts.WebhookConfigName).Body(data).Do().Error()
+	if err != nil {
+		return fmt.Errorf("failed to patch webhook configuration %s: %v", m.opts.WebhookConfigName, err)
+	}
+	glog.Infof("updated caBundle of webhook configuration %s", m.opts.WebhookConfigName)
+	m.setPublished(caBundle)
+	return nil
+}
+
+func (m *Manager) setPublished(caBundle []byte) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.published = caBundle
+}
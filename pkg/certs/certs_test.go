@@ -0,0 +1,64 @@
+package certs
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/util/cert"
+)
+
+func TestRenewCA(t *testing.T) {
+	// the generated CA is valid for ten years, the serving certificate for
+	// one year.
+	m := &Manager{opts: Options{ServiceName: "dumbledore", SecretNamespace: "kube-system", RotateBefore: 30 * 24 * time.Hour}}
+	secret := &coreV1.Secret{}
+	renew := func() {
+		t.Helper()
+		if err := m.renew(secret); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.load(secret); err != nil {
+			t.Fatal(err)
+		}
+	}
+	issuedBy := func(ca *x509.Certificate) bool {
+		return m.servingCert.CheckSignatureFrom(ca) == nil
+	}
+	renew()
+	firstCA := m.caCert
+	if !issuedBy(firstCA) || m.nextCACert != nil || m.needsRenewal() {
+		t.Fatalf("bootstrap: got next CA %v and renewal %v, want a serving certificate of the CA", m.nextCACert, m.needsRenewal())
+	}
+
+	// the CA is about to expire.
+	m.opts.RotateBefore = 11 * 365 * 24 * time.Hour
+	renew()
+	if m.nextCACert == nil || !issuedBy(firstCA) {
+		t.Fatalf("the next CA must be staged without issuing the serving certificate")
+	}
+	if certs, _ := cert.ParseCertsPEM(m.caBundle); len(certs) != 2 || !certs[0].Equal(firstCA) || !certs[1].Equal(m.nextCACert) {
+		t.Fatalf("bundle must hold the CA and the next CA")
+	}
+	if m.canPromote() {
+		t.Fatalf("the next CA must not sign before the bundle is published")
+	}
+
+	m.setPublished(m.caBundle)
+	if !m.needsRenewal() {
+		t.Fatalf("the published next CA must be switched to")
+	}
+	nextCA := m.nextCACert
+	m.opts.RotateBefore = 30 * 24 * time.Hour
+	renew()
+	if !m.caCert.Equal(nextCA) || m.nextCACert != nil || !issuedBy(nextCA) {
+		t.Fatalf("the serving certificate must be issued by the next CA once it is published")
+	}
+	if certs, _ := cert.ParseCertsPEM(m.caBundle); len(certs) != 2 || !certs[0].Equal(nextCA) || !certs[1].Equal(firstCA) {
+		t.Errorf("bundle must keep the old CA until it expires")
+	}
+	if _, ok := secret.Data[nextCACertKey]; ok {
+		t.Errorf("the next CA must be removed from the secret once it signs")
+	}
+}
@@ -0,0 +1,74 @@
+package v1alpha1
+
+import (
+	v1alpha1 "github.com/k8s-storage/dumbledore/pkg/apis/dumbledore/v1alpha1"
+
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	watch "k8s.io/apimachinery/pkg/watch"
+	scheme "k8s.io/client-go/kubernetes/scheme"
+	rest "k8s.io/client-go/rest"
+)
+
+// ClusterPersistentVolumeAttributePolicyInterface has methods to work with ClusterPersistentVolumeAttributePolicy resources.
+type ClusterPersistentVolumeAttributePolicyInterface interface {
+	Get(name string, options metaV1.GetOptions) (*v1alpha1.ClusterPersistentVolumeAttributePolicy, error)
+	List(opts metaV1.ListOptions) (*v1alpha1.ClusterPersistentVolumeAttributePolicyList, error)
+	Watch(opts metaV1.ListOptions) (watch.Interface, error)
+	UpdateStatus(*v1alpha1.ClusterPersistentVolumeAttributePolicy) (*v1alpha1.ClusterPersistentVolumeAttributePolicy, error)
+}
+
+// clusterPersistentVolumeAttributePolicies implements ClusterPersistentVolumeAttributePolicyInterface
+type clusterPersistentVolumeAttributePolicies struct {
+	client rest.Interface
+}
+
+func newClusterPersistentVolumeAttributePolicies(c *DumbledoreV1alpha1Client) *clusterPersistentVolumeAttributePolicies {
+	return &clusterPersistentVolumeAttributePolicies{
+		client: c.RESTClient(),
+	}
+}
+
+// Get takes name of the policy, and returns the corresponding policy object, and an error if there is any.
+func (c *clusterPersistentVolumeAttributePolicies) Get(name string, options metaV1.GetOptions) (result *v1alpha1.ClusterPersistentVolumeAttributePolicy, err error) {
+	result = &v1alpha1.ClusterPersistentVolumeAttributePolicy{}
+	err = c.client.Get().
+		Resource("clusterpersistentvolumeattributepolicies").
+		Name(name).
+		VersionedParams(&options, scheme.ParameterCodec).
+		Do().
+		Into(result)
+	return
+}
+
+// List takes label and field selectors, and returns the list of policies that match those selectors.
+func (c *clusterPersistentVolumeAttributePolicies) List(opts metaV1.ListOptions) (result *v1alpha1.ClusterPersistentVolumeAttributePolicyList, err error) {
+	result = &v1alpha1.ClusterPersistentVolumeAttributePolicyList{}
+	err = c.client.Get().
+		Resource("clusterpersistentvolumeattributepolicies").
+		VersionedParams(&opts, scheme.ParameterCodec).
+		Do().
+		Into(result)
+	return
+}
+
+// Watch returns a watch.Interface that watches the requested policies.
+func (c *clusterPersistentVolumeAttributePolicies) Watch(opts metaV1.ListOptions) (watch.Interface, error) {
+	opts.Watch = true
+	return c.client.Get().
+		Resource("clusterpersistentvolumeattributepolicies").
+		VersionedParams(&opts, scheme.ParameterCodec).
+		Watch()
+}
+
+// UpdateStatus updates the status subresource of the policy.
+func (c *clusterPersistentVolumeAttributePolicies) UpdateStatus(policy *v1alpha1.ClusterPersistentVolumeAttributePolicy) (result *v1alpha1.ClusterPersistentVolumeAttributePolicy, err error) {
+	result = &v1alpha1.ClusterPersistentVolumeAttributePolicy{}
+	err = c.client.Put().
+		Resource("clusterpersistentvolumeattributepolicies").
+		Name(policy.Name).
+		SubResource("status").
+		Body(policy).
+		Do().
+		Into(result)
+	return
+}
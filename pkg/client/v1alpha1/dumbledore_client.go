@@ -0,0 +1,64 @@
+package v1alpha1
+
+import (
+	v1alpha1 "github.com/k8s-storage/dumbledore/pkg/apis/dumbledore/v1alpha1"
+
+	serializer "k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/client-go/kubernetes/scheme"
+	rest "k8s.io/client-go/rest"
+)
+
+func init() {
+	// the policy types are decoded with the client-go scheme.
+	if err := v1alpha1.AddToScheme(scheme.Scheme); err != nil {
+		panic(err)
+	}
+}
+
+// DumbledoreV1alpha1Client is used to interact with features provided by the dumbledore.k8s-storage.io group.
+type DumbledoreV1alpha1Client struct {
+	restClient rest.Interface
+}
+
+func (c *DumbledoreV1alpha1Client) PersistentVolumeAttributePolicies(namespace string) PersistentVolumeAttributePolicyInterface {
+	return newPersistentVolumeAttributePolicies(c, namespace)
+}
+
+func (c *DumbledoreV1alpha1Client) ClusterPersistentVolumeAttributePolicies() ClusterPersistentVolumeAttributePolicyInterface {
+	return newClusterPersistentVolumeAttributePolicies(c)
+}
+
+// NewForConfig creates a new DumbledoreV1alpha1Client for the given config.
+func NewForConfig(c *rest.Config) (*DumbledoreV1alpha1Client, error) {
+	config := *c
+	if err := setConfigDefaults(&config); err != nil {
+		return nil, err
+	}
+	client, err := rest.RESTClientFor(&config)
+	if err != nil {
+		return nil, err
+	}
+	return &DumbledoreV1alpha1Client{client}, nil
+}
+
+func setConfigDefaults(config *rest.Config) error {
+	gv := v1alpha1.SchemeGroupVersion
+	config.GroupVersion = &gv
+	config.APIPath = "/apis"
+	config.NegotiatedSerializer = serializer.DirectCodecFactory{CodecFactory: scheme.Codecs}
+
+	if config.UserAgent == "" {
+		config.UserAgent = rest.DefaultKubernetesUserAgent()
+	}
+
+	return nil
+}
+
+// RESTClient returns a RESTClient that is used to communicate
+// with API server by this client implementation.
+func (c *DumbledoreV1alpha1Client) RESTClient() rest.Interface {
+	if c == nil {
+		return nil
+	}
+	return c.restClient
+}
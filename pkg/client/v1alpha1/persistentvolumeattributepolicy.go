@@ -0,0 +1,80 @@
+package v1alpha1
+
+import (
+	v1alpha1 "github.com/k8s-storage/dumbledore/pkg/apis/dumbledore/v1alpha1"
+
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	watch "k8s.io/apimachinery/pkg/watch"
+	scheme "k8s.io/client-go/kubernetes/scheme"
+	rest "k8s.io/client-go/rest"
+)
+
+// PersistentVolumeAttributePolicyInterface has methods to work with PersistentVolumeAttributePolicy resources.
+type PersistentVolumeAttributePolicyInterface interface {
+	Get(name string, options metaV1.GetOptions) (*v1alpha1.PersistentVolumeAttributePolicy, error)
+	List(opts metaV1.ListOptions) (*v1alpha1.PersistentVolumeAttributePolicyList, error)
+	Watch(opts metaV1.ListOptions) (watch.Interface, error)
+	UpdateStatus(*v1alpha1.PersistentVolumeAttributePolicy) (*v1alpha1.PersistentVolumeAttributePolicy, error)
+}
+
+// persistentVolumeAttributePolicies implements PersistentVolumeAttributePolicyInterface
+type persistentVolumeAttributePolicies struct {
+	client rest.Interface
+	ns     string
+}
+
+func newPersistentVolumeAttributePolicies(c *DumbledoreV1alpha1Client, namespace string) *persistentVolumeAttributePolicies {
+	return &persistentVolumeAttributePolicies{
+		client: c.RESTClient(),
+		ns:     namespace,
+	}
+}
+
+// Get takes name of the policy, and returns the corresponding policy object, and an error if there is any.
+func (c *persistentVolumeAttributePolicies) Get(name string, options metaV1.GetOptions) (result *v1alpha1.PersistentVolumeAttributePolicy, err error) {
+	result = &v1alpha1.PersistentVolumeAttributePolicy{}
+	err = c.client.Get().
+		Namespace(c.ns).
+		Resource("persistentvolumeattributepolicies").
+		Name(name).
+		VersionedParams(&options, scheme.ParameterCodec).
+		Do().
+		Into(result)
+	return
+}
+
+// List takes label and field selectors, and returns the list of policies that match those selectors.
+func (c *persistentVolumeAttributePolicies) List(opts metaV1.ListOptions) (result *v1alpha1.PersistentVolumeAttributePolicyList, err error) {
+	result = &v1alpha1.PersistentVolumeAttributePolicyList{}
+	err = c.client.Get().
+		Namespace(c.ns).
+		Resource("persistentvolumeattributepolicies").
+		VersionedParams(&opts, scheme.ParameterCodec).
+		Do().
+		Into(result)
+	return
+}
+
+// Watch returns a watch.Interface that watches the requested policies.
+func (c *persistentVolumeAttributePolicies) Watch(opts metaV1.ListOptions) (watch.Interface, error) {
+	opts.Watch = true
+	return c.client.Get().
+		Namespace(c.ns).
+		Resource("persistentvolumeattributepolicies").
+		VersionedParams(&opts, scheme.ParameterCodec).
+		Watch()
+}
+
+// UpdateStatus updates the status subresource of the policy.
+func (c *persistentVolumeAttributePolicies) UpdateStatus(policy *v1alpha1.PersistentVolumeAttributePolicy) (result *v1alpha1.PersistentVolumeAttributePolicy, err error) {
+	result = &v1alpha1.PersistentVolumeAttributePolicy{}
+	err = c.client.Put().
+		Namespace(c.ns).
+		Resource("persistentvolumeattributepolicies").
+		Name(policy.Name).
+		SubResource("status").
+		Body(policy).
+		Do().
+		Into(result)
+	return
+}
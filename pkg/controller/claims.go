@@ -0,0 +1,265 @@
+package controller
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+
+	"github.com/k8s-storage/dumbledore/pkg/metrics"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// ClaimPolicyAnnotation records on the claim the comma separated names
+	// of the rules that mutated it when it was created.
+	ClaimPolicyAnnotation = "dumbledore.k8s-storage.io/claim-policy"
+
+	betaStorageClassAnnotation = "volume.beta.kubernetes.io/storage-class"
+	defaultClassAnnotation     = "storageclass.kubernetes.io/is-default-class"
+	betaDefaultClassAnnotation = "storageclass.beta.kubernetes.io/is-default-class"
+)
+
+// ClaimMutation is applied to the claims matched by a rule when they are
+// created, so that the provisioner sees the storage class and annotations
+// before the volume exists.
+type ClaimMutation struct {
+	// Selector is matched against the claim's labels. Without one, the
+	// rule's selector is matched against the labels of the claim and of the
+	// pods of the workload owning it.
+	Selector *metaV1.LabelSelector `json:"selector,omitempty"`
+	// StorageClassName is set on claims that request no storage class or
+	// the default one.
+	StorageClassName string `json:"storageClassName,omitempty"`
+	// Annotations are set on the claim, e.g. for the provisioner.
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// selector is the parsed Selector, nil if it is not set.
+	selector labels.Selector
+}
+
+// validateClaimMutation checks the claim section of a rule.
+func validateClaimMutation(conf *Config) error {
+	m := conf.Claim
+	if m == nil {
+		return nil
+	}
+	if m.Selector != nil {
+		selector, err := metaV1.LabelSelectorAsSelector(m.Selector)
+		if err != nil {
+			return fmt.Errorf("rule %s: invalid claim selector: %v", conf.Name, err)
+		}
+		m.selector = selector
+	}
+	if len(m.StorageClassName) > 0 {
+		if errs := validation.IsDNS1123Subdomain(m.StorageClassName); len(errs) > 0 {
+			return fmt.Errorf("rule %s: invalid storage class name %s: %s", conf.Name, m.StorageClassName, strings.Join(errs, ", "))
+		}
+	}
+	for k := range m.Annotations {
+		if errs := validation.IsQualifiedName(k); len(errs) > 0 {
+			return fmt.Errorf("rule %s: invalid claim annotation %s: %s", conf.Name, k, strings.Join(errs, ", "))
+		}
+		if k == ClaimPolicyAnnotation {
+			return fmt.Errorf("rule %s: claim annotation %s is set by dumbledore", conf.Name, k)
+		}
+	}
+	if len(m.StorageClassName) == 0 && len(m.Annotations) == 0 {
+		return fmt.Errorf("rule %s: claim sets neither a storage class nor annotations", conf.Name)
+	}
+	return nil
+}
+
+// claimOnly tells whether the rule only mutates claims, it doesn't apply to
+// pods and PVs.
+func (conf *Config) claimOnly() bool {
+	return conf.Claim != nil && len(conf.values()) == 0 && len(conf.JSONPatch) == 0
+}
+
+// MutateClaim applies the claim sections of the rules matching a claim that
+// is being created to it in place. It returns the names of the rules
+// applied, none if no rule matches. Dry runs record no events or metrics.
+// It returns an error if a fail-closed rule can't be evaluated, the claim
+// is not changed then.
+func (c *Controller) MutateClaim(pvc *coreV1.PersistentVolumeClaim, dryRun bool) ([]string, error) {
+	if isExcludedNamespace(pvc.Namespace) {
+		return nil, nil
+	}
+	var matched []*Config
+	var unevaluated []string
+	var nsLabels labels.Set
+	var nsErr error
+	nsRead := false
+	var workload []labels.Set
+	config := c.getConfig()
+	for i := range config {
+		conf := &config[i]
+		if conf.Claim == nil {
+			continue
+		}
+		if len(conf.Namespace) > 0 {
+			if conf.Namespace != pvc.Namespace {
+				continue
+			}
+		} else {
+			if !nsRead {
+				ns, err := c.getNamespaceLabels(pvc.Namespace)
+				nsLabels, nsErr, nsRead = labels.Set(ns), err, true
+			}
+			if nsErr != nil && conf.NamespaceSelector != nil {
+				if c.claimMatches(conf, pvc, &workload) {
+					glog.Warningf("skipping rule %s for claim %s/%s: %v", conf.Name, pvc.Namespace, claimName(pvc), nsErr)
+					if conf.failurePolicy() == FailClosed {
+						unevaluated = append(unevaluated, conf.Name)
+					}
+				}
+				continue
+			}
+			if !conf.namespaceSelector.Matches(nsLabels) {
+				continue
+			}
+		}
+		if c.claimMatches(conf, pvc, &workload) {
+			matched = append(matched, conf)
+		}
+	}
+	if len(unevaluated) > 0 {
+		return nil, fmt.Errorf("rules %v can't be evaluated: %v", unevaluated, nsErr)
+	}
+	if len(matched) == 0 {
+		return nil, nil
+	}
+	sortRules(matched)
+
+	var rules []string
+	class, classRule := "", ""
+	annotations := map[string]string{}
+	for _, conf := range matched {
+		rules = append(rules, conf.Name)
+		if !dryRun {
+			metrics.ClaimMutations.WithLabelValues(conf.Name).Inc()
+		}
+		if len(conf.Claim.StorageClassName) > 0 {
+			class, classRule = conf.Claim.StorageClassName, conf.Name
+		}
+		for k, v := range conf.Claim.Annotations {
+			annotations[k] = v
+		}
+	}
+	glog.V(3).Infof("rules %v match claim %s/%s", rules, pvc.Namespace, claimName(pvc))
+
+	var changes []string
+	if len(class) > 0 {
+		if ok, reason := c.canChooseClass(pvc); ok {
+			pvc.Spec.StorageClassName = &class
+			changes = append(changes, "storage class "+class)
+		} else {
+			changes = append(changes, fmt.Sprintf("storage class %s of rule %s not set, %s", class, classRule, reason))
+		}
+	}
+	if pvc.Annotations == nil {
+		pvc.Annotations = map[string]string{}
+	}
+	keys := make([]string, 0, len(annotations))
+	for k, v := range annotations {
+		pvc.Annotations[k] = v
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if len(keys) > 0 {
+		changes = append(changes, "annotations "+strings.Join(keys, ", "))
+	}
+	pvc.Annotations[ClaimPolicyAnnotation] = strings.Join(rules, ",")
+	if len(pvc.Name) > 0 && !dryRun {
+		c.recorder.Eventf(pvc, coreV1.EventTypeNormal, EventClaimMutated, "Rules %v set %s", rules, strings.Join(changes, "; "))
+	}
+	return rules, nil
+}
+
+// claimMatches tells whether the selector of the rule matches the claim, or
+// else the workload of the claim. The workload labels are read once.
+func (c *Controller) claimMatches(conf *Config, pvc *coreV1.PersistentVolumeClaim, workload *[]labels.Set) bool {
+	if conf.Claim.selector != nil {
+		return conf.Claim.selector.Matches(labels.Set(pvc.Labels))
+	}
+	if *workload == nil {
+		*workload = c.workloadLabels(pvc)
+	}
+	for _, set := range *workload {
+		if conf.selector.Matches(set) {
+			return true
+		}
+	}
+	return false
+}
+
+// workloadLabels returns the label sets the rule selectors are matched
+// against for a claim: its own labels, which include the pod selector of the
+// StatefulSet that created it, and the labels of the pod or the pod template
+// of the StatefulSet owning it.
+func (c *Controller) workloadLabels(pvc *coreV1.PersistentVolumeClaim) []labels.Set {
+	sets := []labels.Set{labels.Set(pvc.Labels)}
+	owner := metaV1.GetControllerOf(pvc)
+	if owner == nil {
+		return sets
+	}
+	switch owner.Kind {
+	case "Pod":
+		// generic ephemeral volumes.
+		pod, err := c.clientset.CoreV1().Pods(pvc.Namespace).Get(owner.Name, metaV1.GetOptions{})
+		if err != nil {
+			glog.Warningf("failed to get pod %s/%s owning claim %s: %v", pvc.Namespace, owner.Name, claimName(pvc), err)
+			return sets
+		}
+		sets = append(sets, labels.Set(pod.Labels))
+	case "StatefulSet":
+		set, err := c.clientset.AppsV1().StatefulSets(pvc.Namespace).Get(owner.Name, metaV1.GetOptions{})
+		if err != nil {
+			glog.Warningf("failed to get statefulset %s/%s owning claim %s: %v", pvc.Namespace, owner.Name, claimName(pvc), err)
+			return sets
+		}
+		sets = append(sets, labels.Set(set.Spec.Template.Labels))
+	}
+	return sets
+}
+
+// canChooseClass tells whether the storage class of the claim may be set, or
+// why not: it requests no storage class, or the default one the
+// DefaultStorageClass admission plugin set before the webhook is called.
+// Claims of pre-bound volumes are left alone.
+func (c *Controller) canChooseClass(pvc *coreV1.PersistentVolumeClaim) (bool, string) {
+	if len(pvc.Spec.VolumeName) > 0 {
+		return false, fmt.Sprintf("the claim is bound to volume %s", pvc.Spec.VolumeName)
+	}
+	if class, ok := pvc.Annotations[betaStorageClassAnnotation]; ok {
+		return false, fmt.Sprintf("the claim requests storage class %q", class)
+	}
+	if pvc.Spec.StorageClassName == nil {
+		return true, ""
+	}
+	class := *pvc.Spec.StorageClassName
+	if len(class) == 0 {
+		return false, "the claim requests no dynamic provisioning"
+	}
+	sc, err := c.clientset.StorageV1().StorageClasses().Get(class, metaV1.GetOptions{})
+	if err != nil {
+		glog.Warningf("failed to get storage class %s: %v", class, err)
+		return false, fmt.Sprintf("storage class %s of the claim can't be read: %v", class, err)
+	}
+	if sc.Annotations[defaultClassAnnotation] == "true" || sc.Annotations[betaDefaultClassAnnotation] == "true" {
+		return true, ""
+	}
+	return false, fmt.Sprintf("the claim requests storage class %s", class)
+}
+
+func claimName(pvc *coreV1.PersistentVolumeClaim) string {
+	if len(pvc.Name) > 0 {
+		return pvc.Name
+	}
+	return pvc.GenerateName
+}
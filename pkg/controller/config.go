@@ -0,0 +1,289 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/ghodss/yaml"
+	"github.com/golang/glog"
+
+	"github.com/k8s-storage/dumbledore/pkg/apis/dumbledore/v1alpha1"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// ConfigMapToConfig parses the rules in the "config" key of the ConfigMap.
+// Unknown fields are rejected so that typos fail loudly instead of leaving
+// fields empty.
+func ConfigMapToConfig(cm *coreV1.ConfigMap) ([]Config, error) {
+	data, err := yaml.YAMLToJSON([]byte(cm.Data["config"]))
+	if err != nil {
+		return nil, err
+	}
+	var c []Config
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&c); err != nil {
+		return nil, err
+	}
+	for i := range c {
+		if err := validateConfig(&c[i]); err != nil {
+			return nil, err
+		}
+	}
+	glog.V(5).Infof("configs %+v", c)
+	return c, nil
+}
+
+// PoliciesToConfig converts the policy objects into rules. Rules of
+// namespaced policies are named namespace/name and only apply to pods in
+// their own namespace. Invalid policies are skipped, so that one policy can't
+// hold back the others, and returned by rule name with their errors.
+func PoliciesToConfig(clusterPolicies []*v1alpha1.ClusterPersistentVolumeAttributePolicy, policies []*v1alpha1.PersistentVolumeAttributePolicy) ([]Config, map[string]error) {
+	var c []Config
+	invalid := map[string]error{}
+	for _, p := range clusterPolicies {
+		conf, err := specToConfig(p.Name, "", &p.Spec)
+		if err != nil {
+			invalid[p.Name] = err
+			continue
+		}
+		c = append(c, *conf)
+	}
+	for _, p := range policies {
+		name := p.Namespace + "/" + p.Name
+		conf, err := specToConfig(name, p.Namespace, &p.Spec)
+		if err != nil {
+			invalid[name] = err
+			continue
+		}
+		c = append(c, *conf)
+	}
+	glog.V(5).Infof("configs %+v", c)
+	return c, invalid
+}
+
+func specToConfig(name, namespace string, spec *v1alpha1.PersistentVolumeAttributePolicySpec) (*Config, error) {
+	attrs, err := json.Marshal(spec.Attributes)
+	if err != nil {
+		return nil, fmt.Errorf("policy %s: %v", name, err)
+	}
+	if len(namespace) > 0 && spec.NamespaceSelector != nil {
+		return nil, fmt.Errorf("policy %s: namespaced policies can't have a namespace selector", name)
+	}
+	conf := &Config{
+		Name:                 name,
+		Namespace:            namespace,
+		Label:                spec.Label,
+		Selector:             spec.Selector,
+		NamespaceSelector:    spec.NamespaceSelector,
+		Attributes:           string(attrs),
+		Priority:             spec.Priority,
+		MergeStrategy:        MergeStrategy(spec.MergeStrategy),
+		Enforcement:          Enforcement(spec.Enforcement),
+		FailurePolicy:        FailurePolicy(spec.FailurePolicy),
+		Target:               Target(spec.Target),
+		Drivers:              spec.Drivers,
+		StorageClasses:       spec.StorageClasses,
+		StorageClassSelector: spec.StorageClassSelector,
+	}
+	if spec.Claim != nil {
+		conf.Claim = &ClaimMutation{
+			Selector:         spec.Claim.Selector,
+			StorageClassName: spec.Claim.StorageClassName,
+			Annotations:      spec.Claim.Annotations,
+		}
+	}
+	for _, key := range spec.GeneratedKeys {
+		conf.GeneratedKeys = append(conf.GeneratedKeys, GeneratedKey{
+			Attribute: key.Attribute,
+			Length:    int(key.Length),
+		})
+	}
+	for _, attr := range spec.SecretAttributes {
+		conf.SecretAttributes = append(conf.SecretAttributes, SecretAttribute{
+			Attribute: attr.Attribute,
+			SecretKeyRef: SecretKeySelector{
+				Namespace: attr.SecretKeyRef.Namespace,
+				Name:      attr.SecretKeyRef.Name,
+				Key:       attr.SecretKeyRef.Key,
+			},
+		})
+	}
+	conf.Sensitive = spec.Sensitive
+	for _, attr := range spec.Monotonic {
+		conf.Monotonic = append(conf.Monotonic, MonotonicAttribute{
+			Attribute: attr.Attribute,
+			Values:    attr.Values,
+		})
+	}
+	conf.Immutable = spec.Immutable
+	for _, op := range spec.JSONPatch {
+		value := op.Value.Raw
+		if value == nil {
+			value = []byte("null")
+		}
+		conf.JSONPatch = append(conf.JSONPatch, PatchOperation{
+			Op:    op.Op,
+			Path:  op.Path,
+			From:  op.From,
+			Value: json.RawMessage(value),
+		})
+	}
+	if err := validateConfig(conf); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// validateConfig checks the rule and parses its selector.
+func validateConfig(conf *Config) error {
+	if len(conf.Name) == 0 {
+		return fmt.Errorf("rule without name")
+	}
+	switch {
+	case len(conf.Label) > 0 && conf.Selector != nil:
+		return fmt.Errorf("rule %s: only one of label and selector can be set", conf.Name)
+	case len(conf.Label) > 0:
+		conf.selector = labels.SelectorFromSet(labels.Set{"app": conf.Label})
+	case conf.Selector != nil:
+		selector, err := metaV1.LabelSelectorAsSelector(conf.Selector)
+		if err != nil {
+			return fmt.Errorf("rule %s: invalid selector: %v", conf.Name, err)
+		}
+		conf.selector = selector
+	default:
+		return fmt.Errorf("rule %s: no label or selector", conf.Name)
+	}
+	conf.namespaceSelector = labels.Everything()
+	if conf.NamespaceSelector != nil {
+		selector, err := metaV1.LabelSelectorAsSelector(conf.NamespaceSelector)
+		if err != nil {
+			return fmt.Errorf("rule %s: invalid namespace selector: %v", conf.Name, err)
+		}
+		conf.namespaceSelector = selector
+	}
+	if conf.StorageClassSelector != nil {
+		selector, err := metaV1.LabelSelectorAsSelector(conf.StorageClassSelector)
+		if err != nil {
+			return fmt.Errorf("rule %s: invalid storage class selector: %v", conf.Name, err)
+		}
+		conf.storageClassSelector = selector
+	}
+	if err := validateClaimMutation(conf); err != nil {
+		return err
+	}
+	switch conf.MergeStrategy {
+	case "", MergeOverride, MergeKeepExisting, MergeFailOnConflict:
+	default:
+		return fmt.Errorf("rule %s: unknown merge strategy %q", conf.Name, conf.MergeStrategy)
+	}
+	switch conf.Enforcement {
+	case "", EnforcementBestEffort, EnforcementStrict:
+	default:
+		return fmt.Errorf("rule %s: unknown enforcement %q", conf.Name, conf.Enforcement)
+	}
+	switch conf.FailurePolicy {
+	case "", FailOpen, FailClosed:
+	default:
+		return fmt.Errorf("rule %s: unknown failure policy %q", conf.Name, conf.FailurePolicy)
+	}
+	switch conf.Target {
+	case "", TargetAnnotation, TargetSpec, TargetBoth:
+	default:
+		return fmt.Errorf("rule %s: unknown target %q", conf.Name, conf.Target)
+	}
+	if conf.Target == TargetSpec && len(conf.JSONPatch) > 0 {
+		return fmt.Errorf("rule %s: json patch only applies to the annotation", conf.Name)
+	}
+	attrs := map[string]interface{}{}
+	if len(conf.Attributes) == 0 && (len(conf.GeneratedKeys)+len(conf.SecretAttributes) > 0 || conf.Claim != nil) {
+		conf.Attributes = "{}"
+	}
+	if err := json.Unmarshal([]byte(conf.Attributes), &attrs); err != nil {
+		return fmt.Errorf("rule %s: attributes are not a JSON object: %v", conf.Name, err)
+	}
+	for _, key := range conf.GeneratedKeys {
+		if len(key.Attribute) == 0 {
+			return fmt.Errorf("rule %s: generated key without attribute", conf.Name)
+		}
+		if _, ok := attrs[key.Attribute]; ok {
+			return fmt.Errorf("rule %s: %s is both an attribute and a generated key", conf.Name, key.Attribute)
+		}
+		if key.Length < 0 || key.Length > maxKeyLength {
+			return fmt.Errorf("rule %s: generated key %s must be at most %d bytes", conf.Name, key.Attribute, maxKeyLength)
+		}
+	}
+	if err := validateSecretAttributes(conf, attrs); err != nil {
+		return err
+	}
+	for _, attr := range conf.Immutable {
+		if len(attr) == 0 {
+			return fmt.Errorf("rule %s: immutable attribute without name", conf.Name)
+		}
+	}
+	for _, attr := range conf.Monotonic {
+		if len(attr.Attribute) == 0 {
+			return fmt.Errorf("rule %s: monotonic attribute without name", conf.Name)
+		}
+		if len(attr.Values) == 0 {
+			return fmt.Errorf("rule %s: monotonic attribute %s without values", conf.Name, attr.Attribute)
+		}
+		seen := map[string]bool{}
+		for _, v := range attr.Values {
+			if seen[v] {
+				return fmt.Errorf("rule %s: monotonic attribute %s has value %s twice", conf.Name, attr.Attribute, v)
+			}
+			seen[v] = true
+		}
+	}
+	if err := validatePatch(conf.JSONPatch); err != nil {
+		return fmt.Errorf("rule %s: invalid json patch: %v", conf.Name, err)
+	}
+	for _, k := range patchKeys(conf.JSONPatch) {
+		if conf.isSensitive(k) {
+			return fmt.Errorf("rule %s: json patch can't change sensitive attribute %s", conf.Name, k)
+		}
+	}
+	for k, v := range attrs {
+		if !isTemplate(v) {
+			continue
+		}
+		if _, err := parseTemplate(k, v.(string)); err != nil {
+			return fmt.Errorf("rule %s: invalid template: %v", conf.Name, err)
+		}
+	}
+	return nil
+}
+
+// logConfigDiff logs the rules added, removed and changed by a reload.
+func logConfigDiff(old, new []Config) {
+	oldRules := map[string]Config{}
+	for _, conf := range old {
+		oldRules[conf.Name] = conf
+	}
+	var added, changed []string
+	for _, conf := range new {
+		oldConf, ok := oldRules[conf.Name]
+		if !ok {
+			added = append(added, conf.Name)
+		} else if !reflect.DeepEqual(oldConf, conf) {
+			changed = append(changed, conf.Name)
+		}
+		delete(oldRules, conf.Name)
+	}
+	var removed []string
+	for name := range oldRules {
+		removed = append(removed, name)
+	}
+	sort.Strings(removed)
+	if len(added)+len(removed)+len(changed) == 0 {
+		return
+	}
+	glog.Infof("rules reloaded: added %v, removed %v, changed %v", added, removed, changed)
+}
@@ -0,0 +1,166 @@
+package controller
+
+import (
+	"github.com/golang/glog"
+
+	"github.com/k8s-storage/dumbledore/pkg/apis/dumbledore/v1alpha1"
+	policyclient "github.com/k8s-storage/dumbledore/pkg/client/v1alpha1"
+	"github.com/k8s-storage/dumbledore/pkg/metrics"
+
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// ConfigWatcher watches the rule source and swaps the rules of the
+// controller whenever it changes. If the ConfigMap fails to parse, the last
+// good rules stay in effect; of an invalid policy the last valid version
+// stays in effect.
+type ConfigWatcher struct {
+	ctrl      *Controller
+	informers []cache.Controller
+}
+
+// NewConfigMapWatcher watches the IntializerConfigmapName ConfigMap.
+func NewConfigMapWatcher(clientset *kubernetes.Clientset, ctrl *Controller) *ConfigWatcher {
+	w := &ConfigWatcher{ctrl: ctrl}
+
+	cmListWatcher := cache.NewListWatchFromClient(
+		clientset.CoreV1().RESTClient(),
+		"configmaps",
+		IntializerNamespace,
+		fields.OneTermEqualSelector("metadata.name", IntializerConfigmapName))
+
+	load := func(obj interface{}) {
+		cm := obj.(*coreV1.ConfigMap)
+		conf, err := ConfigMapToConfig(cm)
+		if err == nil {
+			err = w.ctrl.ValidateRules(conf)
+		}
+		if err != nil {
+			glog.Errorf("failed to parse configmap %s/%s, keeping the last good rules: %v", cm.Namespace, cm.Name, err)
+			metrics.ConfigReloads.WithLabelValues("failure").Inc()
+			return
+		}
+		w.ctrl.SetConfig(conf)
+		metrics.ConfigReloads.WithLabelValues("success").Inc()
+	}
+	_, cmController := cache.NewInformer(
+		cmListWatcher,
+		&coreV1.ConfigMap{},
+		resyncPeriod,
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: load,
+			UpdateFunc: func(old, new interface{}) {
+				load(new)
+			},
+			DeleteFunc: func(obj interface{}) {
+				glog.Warningf("configmap %s/%s deleted, keeping the last good rules", IntializerNamespace, IntializerConfigmapName)
+			},
+		},
+	)
+	w.informers = append(w.informers, cmController)
+	return w
+}
+
+// NewPolicyWatcher watches the cluster and namespaced policy objects.
+func NewPolicyWatcher(policyClient *policyclient.DumbledoreV1alpha1Client, ctrl *Controller) *ConfigWatcher {
+	w := &ConfigWatcher{ctrl: ctrl}
+
+	var clusterStore, store cache.Store
+	// reported are the errors of the invalid policies already logged.
+	reported := map[string]string{}
+	// lastValid are the last valid rules of the policies.
+	lastValid := map[string]Config{}
+	load := func() {
+		var clusterPolicies []*v1alpha1.ClusterPersistentVolumeAttributePolicy
+		for _, obj := range clusterStore.List() {
+			clusterPolicies = append(clusterPolicies, obj.(*v1alpha1.ClusterPersistentVolumeAttributePolicy))
+		}
+		var policies []*v1alpha1.PersistentVolumeAttributePolicy
+		for _, obj := range store.List() {
+			policies = append(policies, obj.(*v1alpha1.PersistentVolumeAttributePolicy))
+		}
+		conf, invalid := PoliciesToConfig(clusterPolicies, policies)
+		var valid []Config
+		valids := map[string]Config{}
+		for _, rule := range conf {
+			if err := w.ctrl.ValidateRules([]Config{rule}); err != nil {
+				invalid[rule.Name] = err
+				continue
+			}
+			valid = append(valid, rule)
+			valids[rule.Name] = rule
+		}
+		for name, err := range invalid {
+			last, ok := lastValid[name]
+			if ok {
+				valid = append(valid, last)
+				valids[name] = last
+			}
+			if reported[name] == err.Error() {
+				continue
+			}
+			if ok {
+				glog.Errorf("invalid policy %s, keeping its last valid version: %v", name, err)
+			} else {
+				glog.Errorf("skipping invalid policy %s: %v", name, err)
+			}
+		}
+		lastValid = valids
+		reported = map[string]string{}
+		for name, err := range invalid {
+			reported[name] = err.Error()
+		}
+		w.ctrl.setConfig(valid, invalid)
+		if len(invalid) > 0 {
+			metrics.ConfigReloads.WithLabelValues("partial").Inc()
+			return
+		}
+		metrics.ConfigReloads.WithLabelValues("success").Inc()
+	}
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			load()
+		},
+		UpdateFunc: func(old, new interface{}) {
+			load()
+		},
+		DeleteFunc: func(obj interface{}) {
+			load()
+		},
+	}
+
+	restClient := policyClient.RESTClient()
+	clusterStore, clusterController := cache.NewInformer(
+		cache.NewListWatchFromClient(restClient, "clusterpersistentvolumeattributepolicies", coreV1.NamespaceAll, fields.Everything()),
+		&v1alpha1.ClusterPersistentVolumeAttributePolicy{},
+		resyncPeriod,
+		handler,
+	)
+	store, controller := cache.NewInformer(
+		cache.NewListWatchFromClient(restClient, "persistentvolumeattributepolicies", coreV1.NamespaceAll, fields.Everything()),
+		&v1alpha1.PersistentVolumeAttributePolicy{},
+		resyncPeriod,
+		handler,
+	)
+	w.informers = append(w.informers, clusterController, controller)
+	return w
+}
+
+func (w *ConfigWatcher) Run(stop <-chan struct{}) {
+	for _, informer := range w.informers {
+		go informer.Run(stop)
+	}
+}
+
+// HasSynced returns true once the rule source was listed.
+func (w *ConfigWatcher) HasSynced() bool {
+	for _, informer := range w.informers {
+		if !informer.HasSynced() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,354 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/golang/glog"
+
+	"github.com/k8s-storage/dumbledore/pkg/metrics"
+
+	coreV1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+type ClaimConflictStrategy string
+
+const (
+	// ClaimConflictReject rejects a pod whose attributes conflict with those
+	// of another pod sharing a claim.
+	ClaimConflictReject ClaimConflictStrategy = "reject"
+	// ClaimConflictKeepStricter keeps the stricter value: the later one in
+	// the order of a rule declaring the attribute monotonic, or else the
+	// value of the stricter rule: a strict rule over a best-effort one, then
+	// a fail-closed rule over a fail-open one, then a cluster rule over a
+	// namespaced one, then the rule with the higher priority. On a tie the
+	// existing value is kept.
+	ClaimConflictKeepStricter ClaimConflictStrategy = "keep-stricter"
+	// ClaimConflictCondition applies the value of the pod admitted last and
+	// raises the Conflict condition of the rules.
+	ClaimConflictCondition ClaimConflictStrategy = "condition"
+)
+
+// ClaimConflicts decides how conflicts between pods sharing a claim are
+// handled.
+var ClaimConflicts = ClaimConflictCondition
+
+// ConflictsAnnotation records on the PV the attributes that conflicted when
+// they were last applied, with the rules that wanted different values. The
+// rule whose value was applied comes first.
+const ConflictsAnnotation = "dumbledore.k8s-storage.io/conflicts"
+
+// rejectedError rejects a pod regardless of its failure policy.
+type rejectedError struct {
+	error
+}
+
+// desiredValue is the value another pod wants for an attribute of a claim.
+type desiredValue struct {
+	value interface{}
+	rule  string
+}
+
+// claimAttributes resolves the attributes of a pod for one of its claims
+// against those of other pods sharing the claim, both pending and already on
+// its PV, and merges them with the pending ones. It returns a rejectedError
+// if the pod must be rejected, e.g. because it would change a protected
+// attribute.
+func (c *Controller) claimAttributes(pod *coreV1.Pod, name string, attrs *Attributes) (*Attributes, error) {
+	pvc, err := c.getPVC(pod.Namespace, name)
+	if apierrors.IsNotFound(err) {
+		return attrs, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pvc %s/%s: %v", pod.Namespace, name, err)
+	}
+
+	desired := map[string]desiredValue{}
+	// current are the attributes on the PV with the pending ones.
+	current := map[string]interface{}{}
+	if pvc.Status.Phase == coreV1.ClaimBound && len(pvc.Spec.VolumeName) > 0 {
+		pv, err := c.getPV(pvc.Spec.VolumeName)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return nil, fmt.Errorf("failed to get pv %s: %v", pvc.Spec.VolumeName, err)
+		}
+		if err == nil {
+			effective := map[string]EffectiveAttribute{}
+			json.Unmarshal([]byte(pv.Annotations[PVAnnotation]), &current)
+			json.Unmarshal([]byte(pv.Annotations[EffectiveAttributesAnnotation]), &effective)
+			for k, e := range effective {
+				if v, ok := current[k]; ok {
+					desired[k] = desiredValue{value: v, rule: e.Rule}
+				}
+			}
+		}
+	}
+	pending := c.getPodPVCMap(pod.Namespace, name)
+	if data, ok := pvc.Annotations[PendingAttributesAnnotation]; pending == nil && ok {
+		if pending, err = c.decodePending(pod.Namespace, data); err != nil {
+			glog.Warningf("failed to parse pending attributes of pvc %s/%s: %v", pod.Namespace, name, err)
+		}
+	}
+	if pending != nil {
+		for k, v := range pending.Values {
+			desired[k] = desiredValue{value: v, rule: pending.Sources[k]}
+			if v == nil {
+				delete(current, k)
+			} else {
+				current[k] = v
+			}
+		}
+	}
+
+	g := c.getGuards(pod.Namespace)
+	resolved, err := c.resolveConflicts(pod, name, attrs, desired, g)
+	if err != nil {
+		return nil, err
+	}
+	if err := g.checkAll(resolved, current, c.applyValues(resolved, current)); err != nil {
+		c.recordPodEvent(pod, coreV1.EventTypeWarning, EventProtectedAttribute, "Rules %v not applied to claim %s, pod rejected: %v", attrs.Rules, name, err)
+		return nil, &rejectedError{fmt.Errorf("claim %s: %v", name, err)}
+	}
+	if pending != nil {
+		resolved = pending.mergeIntent(resolved)
+	}
+	return resolved, nil
+}
+
+// resolveConflicts compares the attributes of a pod with the values other
+// rules want for the claim. Values that can only be compared once they are
+// rendered are not compared.
+func (c *Controller) resolveConflicts(pod *coreV1.Pod, claim string, attrs *Attributes, desired map[string]desiredValue, g *guards) (*Attributes, error) {
+	resolved := attrs
+	keys := make([]string, 0, len(attrs.Values))
+	for k := range attrs.Values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := attrs.Values[k]
+		rule := attrs.Sources[k]
+		d, ok := desired[k]
+		// the value conflicts if it changes the value of the other rule.
+		if !ok || attrs.hasRule(d.rule) || !isPlainValue(v) || reflect.DeepEqual(mergePatch(d.value, v, true), d.value) {
+			continue
+		}
+		if ClaimConflicts == ClaimConflictReject {
+			metrics.ClaimConflicts.WithLabelValues("rejected").Inc()
+			c.recordPodEvent(pod, coreV1.EventTypeWarning, EventClaimConflict, "Attribute %s of rule %s conflicts with rule %s on claim %s, pod rejected", k, rule, d.rule, claim)
+			return nil, &rejectedError{fmt.Errorf("attribute %s of rule %s conflicts with rule %s on claim %s", k, rule, d.rule, claim)}
+		}
+		if resolved == attrs {
+			resolved = attrs.copy()
+		}
+		if ClaimConflicts == ClaimConflictKeepStricter && !c.isStricter(g, k, v, rule, d) {
+			metrics.ClaimConflicts.WithLabelValues("kept_existing").Inc()
+			c.recordPodEvent(pod, coreV1.EventTypeWarning, EventClaimConflict, "Attribute %s of rule %s conflicts with rule %s on claim %s, keeping the value of rule %s", k, rule, d.rule, claim, d.rule)
+			resolved.remove(k)
+			resolved.conflicts[k] = []string{d.rule, rule}
+			continue
+		}
+		metrics.ClaimConflicts.WithLabelValues("overridden").Inc()
+		c.recordPodEvent(pod, coreV1.EventTypeWarning, EventClaimConflict, "Attribute %s of rule %s conflicts with rule %s on claim %s, overriding it", k, rule, d.rule, claim)
+		resolved.conflicts[k] = []string{rule, d.rule}
+	}
+	return resolved, nil
+}
+
+// isStricter tells whether the value v of rule a is stricter than the value
+// wanted by another rule. Values ordered by a rule declaring the attribute
+// monotonic are compared by that order, otherwise the rules are compared. A
+// rule that is gone is never stricter.
+func (c *Controller) isStricter(g *guards, k string, v interface{}, a string, d desiredValue) bool {
+	if stricter, ok := g.isStricter(k, v, d.value); ok {
+		return stricter
+	}
+	b := d.rule
+	var confA, confB *Config
+	config := c.getConfig()
+	for i := range config {
+		switch config[i].Name {
+		case a:
+			confA = &config[i]
+		case b:
+			confB = &config[i]
+		}
+	}
+	switch {
+	case confA == nil:
+		return false
+	case confB == nil:
+		return true
+	case confA.enforcement() != confB.enforcement():
+		return confA.enforcement() == EnforcementStrict
+	case confA.failurePolicy() != confB.failurePolicy():
+		return confA.failurePolicy() == FailClosed
+	case (len(confA.Namespace) > 0) != (len(confB.Namespace) > 0):
+		return len(confA.Namespace) == 0
+	}
+	return confA.Priority > confB.Priority
+}
+
+// isPlainValue tells whether the value is applied as it is.
+func isPlainValue(v interface{}) bool {
+	switch v.(type) {
+	case generatedKey, secretValue:
+		return false
+	}
+	return !isTemplate(v)
+}
+
+// applyValues returns the attributes once the values and the JSON patches of
+// the rules are applied to them, the attributes are not changed. Patches that
+// fail are skipped, the controller reports them when it updates the PV.
+func (c *Controller) applyValues(attrs *Attributes, current map[string]interface{}) map[string]interface{} {
+	patched := make(map[string]interface{}, len(current))
+	for k, v := range current {
+		patched[k] = v
+	}
+	for k, v := range attrs.Values {
+		if v == nil {
+			delete(patched, k)
+		} else {
+			patched[k] = mergePatch(patched[k], v, false)
+		}
+	}
+	for _, p := range attrs.patches {
+		if err := c.checkTenantPatch(attrs, p); err != nil {
+			glog.V(5).Infof("skipping json patch of rule %s: %v", p.Rule, err)
+			continue
+		}
+		// values that are not plain yet are only taken from the patch for
+		// the attributes it changes.
+		result := make(map[string]interface{}, len(patched))
+		for k, v := range patched {
+			result[k] = v
+		}
+		if err := applyPatch(result, p.Ops); err != nil {
+			glog.V(5).Infof("skipping json patch of rule %s: %v", p.Rule, err)
+			continue
+		}
+		for _, k := range patchKeys(p.Ops) {
+			if v, ok := result[k]; ok {
+				patched[k] = v
+			} else {
+				delete(patched, k)
+			}
+		}
+	}
+	return patched
+}
+
+// mergeIntent merges the attributes of a pod admitted later into those
+// pending for a claim. Templated values are rendered with the pod admitted
+// last.
+func (a *Attributes) mergeIntent(newer *Attributes) *Attributes {
+	merged := a.copy()
+	for _, rule := range newer.Rules {
+		if !merged.hasRule(rule) {
+			merged.Rules = append(merged.Rules, rule)
+		}
+	}
+	for k, v := range newer.Values {
+		merged.Values[k] = v
+		merged.Sources[k] = newer.Sources[k]
+		merged.strategies[k] = newer.strategies[k]
+		merged.targets[k] = newer.targets[k]
+		merged.sensitive[k] = newer.sensitive[k]
+	}
+	for rule := range newer.strict {
+		merged.strict[rule] = true
+	}
+	for rule := range newer.failClosed {
+		merged.failClosed[rule] = true
+	}
+	for k, rules := range newer.conflicts {
+		merged.conflicts[k] = rules
+	}
+	for _, p := range newer.patches {
+		merged.setPatch(p)
+	}
+	for i := range newer.pods {
+		merged.setPod(newer.pods[i])
+	}
+	merged.pod = newer.pod
+	return merged
+}
+
+// copy returns a copy of the attributes that is not pending yet.
+func (a *Attributes) copy() *Attributes {
+	cp := &Attributes{
+		Rules:      append([]string(nil), a.Rules...),
+		Values:     map[string]interface{}{},
+		Sources:    map[string]string{},
+		strategies: map[string]MergeStrategy{},
+		targets:    map[string]Target{},
+		sensitive:  map[string]bool{},
+		strict:     map[string]bool{},
+		failClosed: map[string]bool{},
+		conflicts:  map[string][]string{},
+		patches:    append([]rulePatch(nil), a.patches...),
+		pod:        a.pod,
+		pods:       append([]pendingPod(nil), a.pods...),
+	}
+	for k, v := range a.Values {
+		cp.Values[k] = v
+		cp.Sources[k] = a.Sources[k]
+		cp.strategies[k] = a.strategies[k]
+		cp.targets[k] = a.targets[k]
+		cp.sensitive[k] = a.sensitive[k]
+	}
+	for rule := range a.strict {
+		cp.strict[rule] = true
+	}
+	for rule := range a.failClosed {
+		cp.failClosed[rule] = true
+	}
+	for k, rules := range a.conflicts {
+		cp.conflicts[k] = rules
+	}
+	return cp
+}
+
+func (a *Attributes) remove(k string) {
+	delete(a.Values, k)
+	delete(a.Sources, k)
+	delete(a.strategies, k)
+	delete(a.targets, k)
+	delete(a.sensitive, k)
+}
+
+// setPatch sets the JSON Patch operations of a rule, patches of new rules are
+// applied last.
+func (a *Attributes) setPatch(p rulePatch) {
+	for i := range a.patches {
+		if a.patches[i].Rule == p.Rule {
+			a.patches[i] = p
+			return
+		}
+	}
+	a.patches = append(a.patches, p)
+}
+
+// setPod records a pod whose attributes were merged, it replaces a pod
+// recorded earlier with the same attributes.
+func (a *Attributes) setPod(p pendingPod) {
+	var pods []pendingPod
+	for i := range a.pods {
+		if !p.replaces(&a.pods[i]) {
+			pods = append(pods, a.pods[i])
+		}
+	}
+	a.pods = append(pods, p)
+}
+
+func (a *Attributes) hasRule(rule string) bool {
+	for _, r := range a.Rules {
+		if r == rule {
+			return true
+		}
+	}
+	return false
+}
@@ -2,20 +2,28 @@ package controller
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/golang/glog"
 
+	"github.com/k8s-storage/dumbledore/pkg/metrics"
+
 	coreV1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
 )
 
 var (
@@ -23,31 +31,197 @@ var (
 	IntializerConfigmapName string
 	InitializerName         string
 	IntializerNamespace     string
+	// ExcludedNamespaces is a comma separated list of namespaces whose pods
+	// are never touched.
+	ExcludedNamespaces string
+	// KeySecretNamespace is the namespace of the Secrets holding generated
+	// keys.
+	KeySecretNamespace string
+	// SecretValueMode is SecretValuesReference or SecretValuesResolve.
+	SecretValueMode string
+)
+
+const (
+	resyncPeriod = 30 * time.Second
+
+	// PolicyAnnotation records on the PV the comma separated names of the
+	// rules whose attributes were applied to it.
+	PolicyAnnotation = "dumbledore.k8s-storage.io/policy"
+	// EffectiveAttributesAnnotation records on the PV the attributes that
+	// were set and the rules they came from.
+	EffectiveAttributesAnnotation = "dumbledore.k8s-storage.io/effective-attributes"
 )
 
 type Config struct {
-	Name       string `"yaml: name"`
-	Label      string `"yaml: label"`
-	Attributes string `"yaml: attributes"`
+	Name string `json:"name"`
+	// Label is a shorthand for a Selector matching the pod's app label.
+	Label string `json:"label,omitempty"`
+	// Selector is matched against the pod's labels.
+	Selector   *metaV1.LabelSelector `json:"selector,omitempty"`
+	Attributes string                `json:"attributes"`
+	// Priority orders the rules matching a pod, rules with a higher priority
+	// are merged later.
+	Priority int32 `json:"priority,omitempty"`
+	// MergeStrategy decides what happens to attributes that are already set
+	// by a rule merged earlier or on the PV.
+	MergeStrategy MergeStrategy `json:"mergeStrategy,omitempty"`
+	// GeneratedKeys are attributes set to a key generated for every PV.
+	GeneratedKeys []GeneratedKey `json:"generatedKeys,omitempty"`
+	// SecretAttributes are attributes read from Secrets.
+	SecretAttributes []SecretAttribute `json:"secretAttributes,omitempty"`
+	// Sensitive lists attributes whose values are redacted in logs, events
+	// and status. Secret attributes are always sensitive.
+	Sensitive []string `json:"sensitive,omitempty"`
+	// Enforcement decides whether pods are admitted before the attributes
+	// are applied.
+	Enforcement Enforcement `json:"enforcement,omitempty"`
+	// FailurePolicy decides whether pods are admitted if the attributes
+	// can't be applied.
+	FailurePolicy FailurePolicy `json:"failurePolicy,omitempty"`
+	// Monotonic are attributes whose values may only move forward in an
+	// order, on the PVs of all pods.
+	Monotonic []MonotonicAttribute `json:"monotonic,omitempty"`
+	// Immutable are attributes that can't change once set on a PV.
+	Immutable []string `json:"immutable,omitempty"`
+	// JSONPatch are JSON Patch operations applied to the attributes of the
+	// PV after they are merged.
+	JSONPatch []PatchOperation `json:"jsonPatch,omitempty"`
+	// Target decides whether the attributes are written into the PV
+	// annotation, spec.csi.volumeAttributes or both.
+	Target Target `json:"target,omitempty"`
+	// Drivers restricts the rule to CSI volumes of these drivers.
+	Drivers []string `json:"drivers,omitempty"`
+	// StorageClasses restricts the rule to volumes of these storage classes.
+	StorageClasses []string `json:"storageClasses,omitempty"`
+	// StorageClassSelector restricts the rule to volumes of storage classes
+	// matching it.
+	StorageClassSelector *metaV1.LabelSelector `json:"storageClassSelector,omitempty"`
+	// NamespaceSelector is matched against the labels of the pod's
+	// namespace. Only rules of namespaced policies can't have one.
+	NamespaceSelector *metaV1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// Claim sets the storage class and annotations of the claims matched by
+	// the rule when they are created.
+	Claim *ClaimMutation `json:"claim,omitempty"`
+	// Namespace restricts the rule to pods in this namespace, it is set for
+	// namespaced policies.
+	Namespace string `json:"-"`
+
+	// selector is the parsed Label or Selector.
+	selector labels.Selector
+	// namespaceSelector is the parsed NamespaceSelector.
+	namespaceSelector labels.Selector
+	// storageClassSelector is the parsed StorageClassSelector, nil if it is
+	// not set.
+	storageClassSelector labels.Selector
 }
 
 type Controller struct {
-	clientset     *kubernetes.Clientset
-	podPVCMap     map[string]string
-	podPVCLock    *sync.Mutex
+	clientset  *kubernetes.Clientset
+	podPVCMap  map[string]*Attributes
+	podPVCLock *sync.Mutex
+	// running is true while Run runs, e.g. while this replica is the
+	// leader. It is guarded by podPVCLock.
+	running bool
+	// initializing are the admissions of the pods waiting for the
+	// initializer, guarded by podPVCLock.
+	initializing  map[string]*Admission
+	queue         workqueue.RateLimitingInterface
+	recorder      record.EventRecorder
 	podController cache.Controller
+	podStore      cache.Store
 	pvcController cache.Controller
-	config        *[]Config
+	pvcStore      cache.Store
+	pvController  cache.Controller
+	pvStore       cache.Store
+	nsController  cache.Controller
+	nsStore       cache.Store
+	config        []Config
+	// ruleKeys are the attributes set by each rule, it is nil until the
+	// rules are loaded.
+	ruleKeys map[string]map[string]bool
+	// invalidRules are the names of the rules whose policies are invalid,
+	// the attributes they own are kept.
+	invalidRules map[string]bool
+	// profiles are the driver profiles by driver name, nil if attributes
+	// are not validated.
+	profiles   map[string]*DriverProfile
+	configLock *sync.RWMutex
 }
 
-func NewPVInitializer(clientset *kubernetes.Clientset, conf *[]Config) *Controller {
+// NewPVController creates a controller that applies the attributes of the
+// pods handed to it through AdmitPod, e.g. by the admission webhook, to the
+// PVs of their claims. The work is queued and retried until the PVs reflect
+// the attributes, claims that are not bound yet are applied once they are.
+func NewPVController(clientset *kubernetes.Clientset) *Controller {
 	c := &Controller{
-		config:     conf,
-		clientset:  clientset,
-		podPVCMap:  make(map[string]string),
-		podPVCLock: &sync.Mutex{},
+		clientset:    clientset,
+		podPVCMap:    make(map[string]*Attributes),
+		podPVCLock:   &sync.Mutex{},
+		initializing: make(map[string]*Admission),
+		queue:        newQueue(),
+		recorder:     newEventRecorder(clientset),
+		configLock:   &sync.RWMutex{},
 	}
 
+	restClient := clientset.CoreV1().RESTClient()
+	pvcListWatcher := cache.NewListWatchFromClient(
+		restClient,
+		"persistentvolumeclaims",
+		coreV1.NamespaceAll,
+		fields.Everything())
+
+	c.pvcStore, c.pvcController = cache.NewInformer(
+		pvcListWatcher,
+		&coreV1.PersistentVolumeClaim{},
+		resyncPeriod,
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				c.enqueuePVC(obj.(*coreV1.PersistentVolumeClaim))
+			},
+			UpdateFunc: func(old, new interface{}) {
+				c.enqueuePVC(new.(*coreV1.PersistentVolumeClaim))
+			},
+		},
+	)
+
+	pvListWatcher := cache.NewListWatchFromClient(
+		restClient,
+		"persistentvolumes",
+		coreV1.NamespaceAll,
+		fields.Everything())
+	c.pvStore, c.pvController = cache.NewInformer(
+		pvListWatcher,
+		&coreV1.PersistentVolume{},
+		resyncPeriod,
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				c.enqueuePV(obj.(*coreV1.PersistentVolume))
+			},
+			UpdateFunc: func(old, new interface{}) {
+				c.enqueuePV(new.(*coreV1.PersistentVolume))
+			},
+		},
+	)
+
+	nsListWatcher := cache.NewListWatchFromClient(
+		restClient,
+		"namespaces",
+		coreV1.NamespaceAll,
+		fields.Everything())
+	c.nsStore, c.nsController = cache.NewInformer(
+		nsListWatcher,
+		&coreV1.Namespace{},
+		resyncPeriod,
+		cache.ResourceEventHandlerFuncs{},
+	)
+	return c
+}
+
+// NewPVInitializer creates a controller that also watches uninitialized pods
+// and acts as the legacy pod initializer.
+func NewPVInitializer(clientset *kubernetes.Clientset) *Controller {
+	c := NewPVController(clientset)
+
 	restClient := clientset.CoreV1().RESTClient()
 	watchlist := cache.NewListWatchFromClient(restClient, "pods", coreV1.NamespaceAll, fields.Everything())
 
@@ -64,58 +238,43 @@ func NewPVInitializer(clientset *kubernetes.Clientset, conf *[]Config) *Controll
 		},
 	}
 
-	resyncPeriod := 30 * time.Second
-
-	_, podController := cache.NewInformer(
+	c.podStore, c.podController = cache.NewInformer(
 		includeUninitializedWatchlist,
 		&coreV1.Pod{},
 		resyncPeriod,
 		cache.ResourceEventHandlerFuncs{
 			AddFunc: func(obj interface{}) {
-				err := c.addPod(obj.(*coreV1.Pod))
-				if err != nil {
-					glog.Warningf("failed to initialized: %v", err)
-					return
-				}
+				c.enqueuePod(obj.(*coreV1.Pod))
 			},
-		},
-	)
-	c.podController = podController
-
-	pvcListWatcher := cache.NewListWatchFromClient(
-		restClient,
-		"persistentvolumeclaims",
-		coreV1.NamespaceAll,
-		fields.Everything())
-
-	_, pvcController := cache.NewInformer(
-		pvcListWatcher,
-		&coreV1.PersistentVolumeClaim{},
-		resyncPeriod,
-		cache.ResourceEventHandlerFuncs{
 			UpdateFunc: func(old, new interface{}) {
-				err := c.updatePVC(old.(*coreV1.PersistentVolumeClaim), new.(*coreV1.PersistentVolumeClaim))
-				if err != nil {
-					glog.Warningf("failed to initialized: %v", err)
-					return
-				}
+				c.enqueuePod(new.(*coreV1.Pod))
 			},
 		},
 	)
-	c.pvcController = pvcController
 	return c
 }
 
+// Run starts the informers and the workers and blocks until ctx is closed.
+// Then it records the attributes still pending on their claims, so that
+// another replica can take over. Run can't be called again.
 func (c *Controller) Run(ctx <-chan struct{}) {
-	glog.Infof("pod controller starting")
-	go c.podController.Run(ctx)
-	glog.Infof("Waiting for pod informer initial sync")
-	wait.Poll(time.Second, 5*time.Minute, func() (bool, error) {
-		return c.podController.HasSynced(), nil
-	})
-	if !c.podController.HasSynced() {
-		glog.Errorf("pod informer controller initial sync timeout")
-		os.Exit(1)
+	c.setRunning(true)
+	defer c.handOver()
+	defer c.queue.ShutDown()
+	// namespaces missing from the cache are read from the API server, no
+	// need to wait for the sync.
+	go c.nsController.Run(ctx)
+	if c.podController != nil {
+		glog.Infof("pod controller starting")
+		go c.podController.Run(ctx)
+		glog.Infof("Waiting for pod informer initial sync")
+		wait.Poll(time.Second, 5*time.Minute, func() (bool, error) {
+			return c.podController.HasSynced(), nil
+		})
+		if !c.podController.HasSynced() {
+			glog.Errorf("pod informer controller initial sync timeout")
+			os.Exit(1)
+		}
 	}
 	glog.Infof("pvc controller starting")
 	go c.pvcController.Run(ctx)
@@ -127,151 +286,501 @@ func (c *Controller) Run(ctx <-chan struct{}) {
 		glog.Errorf("pvc informer controller initial sync timeout")
 		os.Exit(1)
 	}
+	glog.Infof("pv controller starting")
+	go c.pvController.Run(ctx)
+
+	for i := 0; i < workers; i++ {
+		go wait.Until(c.runWorker, time.Second, ctx)
+	}
+	<-ctx
 }
 
 func (c *Controller) addPod(pod *coreV1.Pod) error {
-	if pod != nil && pod.ObjectMeta.GetInitializers() != nil {
+	if pod != nil && isPendingInitializer(pod) {
 		pendingInitializers := pod.ObjectMeta.GetInitializers().Pending
+		glog.V(3).Infof("Initializing: %s", pod.Name)
+
+		key := pod.Namespace + "/" + pod.Name
+		admission, ok := c.getInitializing(key)
+		if !ok {
+			admission = c.AdmitPod(pod)
+			c.setInitializing(key, admission)
+		}
+		if admission != nil && admission.conflict != nil {
+			// rejected, keep the pod uninitialized.
+			glog.V(3).Infof("pod %s stays uninitialized: %v", key, admission.conflict)
+			return nil
+		}
+		if admission.blocks() {
+			reason, err := admission.check()
+			switch {
+			case err != nil:
+				if err := admission.fail(EventEnforcementFailed, err); err != nil {
+					// keep the pod uninitialized, it is checked again on
+					// the next resync.
+					glog.V(3).Infof("pod %s stays uninitialized: %v", key, err)
+					return nil
+				}
+			case len(reason) > 0:
+				if time.Since(pod.CreationTimestamp.Time) < EnforcementTimeout {
+					glog.V(3).Infof("pod %s waits: %s", key, reason)
+					c.queue.AddAfter(queueKey{kind: podKind, namespace: pod.Namespace, name: pod.Name}, enforcementPollInterval)
+					return nil
+				}
+				err := fmt.Errorf("rules %v not enforced in time: %s", admission.attrs.waitRules(), reason)
+				if err := admission.fail(EventEnforcementTimeout, err); err != nil {
+					glog.V(3).Infof("pod %s stays uninitialized: %v", key, err)
+					return nil
+				}
+			default:
+				admission.enforced()
+			}
+		}
+
+		initializedPod := pod.DeepCopy()
+		// Remove self from the list of pending Initializers while preserving ordering.
+		if len(pendingInitializers) == 1 {
+			initializedPod.ObjectMeta.Initializers = nil
+		} else {
+			initializedPod.ObjectMeta.Initializers.Pending = append(initializedPod.ObjectMeta.Initializers.Pending[:0], pendingInitializers[1:]...)
+		}
+		_, err := c.clientset.CoreV1().Pods(pod.Namespace).Update(initializedPod)
+		if err != nil {
+			return fmt.Errorf("failed to update pod %s/%s: %v", pod.Namespace, pod.Name, err)
+		}
+		c.deleteInitializing(key)
+		glog.V(3).Infof("Initialized: %s", pod.Name)
+		metrics.PodsInitialized.WithLabelValues("initializer").Inc()
+		metrics.PodInitializationDuration.WithLabelValues("initializer").Observe(time.Since(pod.CreationTimestamp.Time).Seconds())
+	}
+
+	return nil
+}
+
+// getInitializing returns the admission of a pod waiting for the
+// initializer, so that a pod is admitted once while it waits for strict
+// rules.
+func (c *Controller) getInitializing(key string) (*Admission, bool) {
+	c.podPVCLock.Lock()
+	defer c.podPVCLock.Unlock()
+	admission, ok := c.initializing[key]
+	return admission, ok
+}
+
+func (c *Controller) setInitializing(key string, admission *Admission) {
+	c.podPVCLock.Lock()
+	defer c.podPVCLock.Unlock()
+	c.initializing[key] = admission
+}
+
+func (c *Controller) deleteInitializing(key string) {
+	c.podPVCLock.Lock()
+	defer c.podPVCLock.Unlock()
+	delete(c.initializing, key)
+}
 
-		if InitializerName == pendingInitializers[0].Name {
-			glog.V(3).Infof("Initializing: %s", pod.Name)
+func isPendingInitializer(pod *coreV1.Pod) bool {
+	initializers := pod.ObjectMeta.GetInitializers()
+	return initializers != nil && len(initializers.Pending) > 0 && initializers.Pending[0].Name == InitializerName
+}
+
+// SetConfig atomically replaces the rules used for pods admitted from now on.
+func (c *Controller) SetConfig(conf []Config) {
+	c.setConfig(conf, nil)
+}
+
+// setConfig is SetConfig with the names of the rules whose policies are
+// invalid. Their last valid version may be among the rules.
+func (c *Controller) setConfig(conf []Config, invalid map[string]error) {
+	c.configLock.Lock()
+	defer c.configLock.Unlock()
+	logConfigDiff(c.config, conf)
+	c.config = conf
+	c.invalidRules = map[string]bool{}
+	for name := range invalid {
+		c.invalidRules[name] = true
+	}
+	c.ruleKeys = map[string]map[string]bool{}
+	for i := range conf {
+		keys := map[string]bool{}
+		if conf[i].target() == TargetSpec {
+			// attributes in the spec are not owned.
+			c.ruleKeys[conf[i].Name] = keys
+			continue
+		}
+		for k := range conf[i].values() {
+			keys[k] = true
+		}
+		// attributes added by the json patch are owned as well.
+		for _, k := range patchKeys(conf[i].JSONPatch) {
+			keys[k] = true
+		}
+		c.ruleKeys[conf[i].Name] = keys
+	}
+}
+
+// getRule returns the rule with the name, or nil if there is none.
+func (c *Controller) getRule(name string) *Config {
+	config := c.getConfig()
+	for i := range config {
+		if config[i].Name == name {
+			return &config[i]
+		}
+	}
+	return nil
+}
 
-			initializedPod := pod.DeepCopy()
-			// Remove self from the list of pending Initializers while preserving ordering.
-			if len(pendingInitializers) == 1 {
-				initializedPod.ObjectMeta.Initializers = nil
-			} else {
-				initializedPod.ObjectMeta.Initializers.Pending = append(pendingInitializers[:0], pendingInitializers[1:]...)
+func (c *Controller) getConfig() []Config {
+	c.configLock.RLock()
+	defer c.configLock.RUnlock()
+	return c.config
+}
 
+// AdmitPod queues the attributes of the rules matching the pod's labels for
+// the PVs of its claims. Claims that are not bound yet are applied once they
+// are. If the controller is not running, e.g. on a replica that is not the
+// leader, the attributes are recorded on the claims for the leader instead.
+// The attributes of pods sharing a claim are merged, conflicts are handled as
+// ClaimConflicts says. It returns nil if no rule matches the pod.
+func (c *Controller) AdmitPod(pod *coreV1.Pod) *Admission {
+	podLabels := pod.ObjectMeta.GetLabels()
+	glog.V(5).Infof("labels %+v", podLabels)
+	attrs, err := c.getAttributes(pod.Namespace, podLabels)
+	if err != nil {
+		glog.Warningf("failed to merge rules for pod %s/%s: %v", pod.Namespace, pod.Name, err)
+		if _, ok := err.(*unevaluatedError); !ok {
+			c.recordPodEvent(pod, coreV1.EventTypeWarning, EventRuleConflict, "Rules not applied: %v", err)
+		}
+		if !attrs.failsClosed() {
+			return nil
+		}
+		return &Admission{c: c, pod: pod, attrs: attrs, err: fmt.Errorf("rules not applied: %v", err), start: time.Now()}
+	}
+	if attrs == nil {
+		if !isExcludedNamespace(pod.Namespace) {
+			c.recordPodEvent(pod, coreV1.EventTypeNormal, EventNoRuleMatched, "No rule matches the pod")
+		}
+		return nil
+	}
+	glog.V(3).Infof("rules %v match pod %s/%s", attrs.Rules, pod.Namespace, pod.Name)
+	for _, rule := range attrs.Rules {
+		metrics.RuleMatches.WithLabelValues(rule).Inc()
+	}
+	c.recordPodEvent(pod, coreV1.EventTypeNormal, EventRuleMatched, "Rules %v match the pod", attrs.Rules)
+	attrs.pod = pod
+	attrs.pods = []pendingPod{newPendingPod(pod, attrs.Rules)}
+	admission := &Admission{c: c, pod: pod, attrs: attrs, start: time.Now()}
+	for _, vol := range pod.Spec.Volumes {
+		if vol.VolumeSource.PersistentVolumeClaim != nil {
+			admission.claims = append(admission.claims, vol.VolumeSource.PersistentVolumeClaim.ClaimName)
+		}
+	}
+	// resolve the conflicts with other pods sharing the claims before
+	// anything is queued, a rejected pod must not change any PV.
+	claimAttrs := make(map[string]*Attributes, len(admission.claims))
+	for _, pvcName := range admission.claims {
+		resolved, err := c.claimAttributes(pod, pvcName, attrs)
+		if _, ok := err.(*rejectedError); ok {
+			admission.conflict = err
+			return admission
+		}
+		if err != nil {
+			glog.Warningf("failed to resolve conflicts on pvc %s/%s: %v", pod.Namespace, pvcName, err)
+			if attrs.failsClosed() && admission.err == nil {
+				admission.err = err
 			}
-			if labels := initializedPod.ObjectMeta.GetLabels(); len(labels) > 0 {
-				glog.V(5).Infof("labels %+v", labels)
-				app, ok := labels["app"]
-				if ok {
-					attr := c.getAttributes(app)
-					if len(attr) > 0 {
-						vols := pod.Spec.Volumes
-						for _, vol := range vols {
-							if vol.VolumeSource.PersistentVolumeClaim != nil {
-								pvcName := vol.VolumeSource.PersistentVolumeClaim.ClaimName
-								glog.V(3).Infof("PVC %s", pvcName)
-								pvc, err := c.clientset.CoreV1().PersistentVolumeClaims(pod.Namespace).Get(pvcName, metaV1.GetOptions{})
-								if err == nil {
-									// if PVC is bound, update PV.
-									pvName := pvc.Spec.VolumeName
-									if len(pvName) > 0 {
-										c.updatePVAnnotation(pvName, attr)
-									} else {
-										// defer till PVC is bound
-										c.updatePodPVCMap(pod.Namespace, pvcName, attr, true /* toAdd */)
-									}
-								}
-							}
-						}
-					}
+			resolved = attrs
+		}
+		claimAttrs[pvcName] = resolved
+	}
+	for _, pvcName := range admission.claims {
+		glog.V(3).Infof("PVC %s", pvcName)
+		if !c.isRunning() {
+			if err := c.persistPendingClaim(pod.Namespace, pvcName, claimAttrs[pvcName]); err != nil {
+				glog.Warningf("%v", err)
+				if attrs.failsClosed() && admission.err == nil {
+					admission.err = err
 				}
 			}
-			_, err := c.clientset.CoreV1().Pods(pod.Namespace).Update(initializedPod)
-			if err != nil {
-				glog.Warning("failed to update pod %s/%s: %v", pod.Namespace, pod.Name, err)
-				return err
-			}
-			glog.V(3).Infof("Initialized: %s", pod.Name)
+			continue
 		}
+		c.updatePodPVCMap(pod.Namespace, pvcName, claimAttrs[pvcName], true /* toAdd */)
+		c.queue.Add(queueKey{kind: pvcKind, namespace: pod.Namespace, name: pvcName})
 	}
+	return admission
+}
 
-	return nil
+// permanentError is a failure to apply attributes that retrying can't fix,
+// like a merge conflict.
+type permanentError struct {
+	error
+}
+
+// unevaluatedError is a failure to evaluate fail-closed rules, e.g. because
+// the labels of the namespace can't be read.
+type unevaluatedError struct {
+	error
+}
+
+// conflictError is a conflicting write of the PV, it is retried right away.
+type conflictError struct {
+	error
 }
 
-func (c *Controller) updatePVAnnotation(pvName, data string) {
+// updatePVAnnotation applies the attributes to the PV of a bound claim. It
+// returns a permanentError if retrying can't fix the failure.
+func (c *Controller) updatePVAnnotation(pvc *coreV1.PersistentVolumeClaim, attrs *Attributes) error {
+	metrics.PVPatchAttempts.Inc()
+	pvName := pvc.Spec.VolumeName
 	pv, err := c.clientset.CoreV1().PersistentVolumes().Get(pvName, metaV1.GetOptions{})
-	if err == nil {
-		glog.V(3).Infof("update PV %s", pv.Name)
-		ann := pv.ObjectMeta.GetAnnotations()
-		if ann == nil {
-			var m map[string]string
-			m[PVAnnotation] = data
-			pv.ObjectMeta.SetAnnotations(m)
-		} else {
-			existingAnn := ann[PVAnnotation]
-			if len(existingAnn) == 0 {
-				// annotation doesn't exist, just add
-				ann[PVAnnotation] = data
-			} else {
-				// append to existing annotation
-				attrs := map[string]interface{}{}
-				existingAttrs := map[string]interface{}{}
-				glog.V(5).Infof("updating %s with %s", existingAnn, data)
-				err1 := json.Unmarshal([]byte(data), &attrs)
-				err2 := json.Unmarshal([]byte(existingAnn), &existingAttrs)
-				if err1 == nil && err2 == nil {
-					for k, v := range attrs {
-						glog.V(5).Infof("add %v %v", k, v)
-						existingAttrs[k] = v
-					}
-					newAnn, err := json.Marshal(existingAttrs)
-					if err == nil {
-						ann[PVAnnotation] = string(newAnn)
+	if err != nil {
+		metrics.PVPatches.WithLabelValues("failed", metrics.ReasonGetPV).Inc()
+		return fmt.Errorf("failed to get pv %s: %v", pvName, err)
+	}
+	glog.V(3).Infof("update PV %s", pv.Name)
+	if attrs = c.scopeAttributes(pvc, pv, attrs); len(attrs.Rules) == 0 {
+		glog.V(3).Infof("no rule applies to pv %s", pv.Name)
+		return nil
+	}
+	values, err := c.renderValues(attrs, pvc, pv)
+	if err != nil {
+		c.recorder.Eventf(pvc, coreV1.EventTypeWarning, EventRenderFailed, "Failed to render the attributes of rules %v for PV %s: %v", attrs.Rules, pv.Name, err)
+		metrics.PVPatches.WithLabelValues("failed", metrics.ReasonRender).Inc()
+		return &permanentError{fmt.Errorf("failed to render attributes for pv %s: %v", pv.Name, err)}
+	}
+	values, err = c.applyGeneratedKeys(pv, values)
+	if err != nil {
+		c.recorder.Eventf(pvc, coreV1.EventTypeWarning, EventKeyGenerationFailed, "Failed to generate keys for PV %s: %v", pv.Name, err)
+		metrics.PVPatches.WithLabelValues("failed", metrics.ReasonKeyGeneration).Inc()
+		return err
+	}
+	if err := c.validateValues(pv, attrs, values); err != nil {
+		glog.Warningf("not applying rules %v to pv %s: %v", attrs.Rules, pv.Name, err)
+		c.recorder.Eventf(pv, coreV1.EventTypeWarning, EventSchemaViolation, "Rules %v not applied: %v", attrs.Rules, err)
+		metrics.PVPatches.WithLabelValues("failed", metrics.ReasonSchema).Inc()
+		return &permanentError{err}
+	}
+	values, err = c.resolveSecretValues(values)
+	if err != nil {
+		c.recorder.Eventf(pvc, coreV1.EventTypeWarning, EventSecretResolveFailed, "Failed to resolve the secret attributes for PV %s: %v", pv.Name, err)
+		metrics.PVPatches.WithLabelValues("failed", metrics.ReasonSecret).Inc()
+		return err
+	}
+	values, specValues := attrs.splitTargets(values)
+	specChanges, err := c.specPatch(pv, attrs, specValues)
+	if _, ok := err.(*permanentError); ok {
+		glog.Warningf("not applying rules %v to pv %s: %v", attrs.Rules, pv.Name, err)
+		c.recorder.Eventf(pv, coreV1.EventTypeWarning, EventVolumeAttributesFailed, "Rules %v not applied: %v", attrs.Rules, err)
+		metrics.PVPatches.WithLabelValues("failed", metrics.ReasonVolumeAttributes).Inc()
+		return err
+	}
+	if err != nil {
+		metrics.PVPatches.WithLabelValues("failed", metrics.ReasonGetPV).Inc()
+		return err
+	}
+	ann := pv.ObjectMeta.GetAnnotations()
+	if ann == nil {
+		ann = map[string]string{}
+	}
+	oldAnn := make(map[string]string, len(ann))
+	for k, v := range ann {
+		oldAnn[k] = v
+	}
+	existingAttrs := map[string]interface{}{}
+	if existingAnn := ann[PVAnnotation]; len(existingAnn) > 0 {
+		glog.V(5).Infof("updating pv %s with %v", pv.Name, attrs.redact(values))
+		if err := json.Unmarshal([]byte(existingAnn), &existingAttrs); err != nil {
+			glog.Warningf("failed to parse annotation of pv %s: %v", pv.Name, err)
+			c.recorder.Eventf(pv, coreV1.EventTypeWarning, EventInvalidAttributes, "Annotation %s is not a JSON object, rules %v not applied: %v", PVAnnotation, attrs.Rules, err)
+			metrics.PVPatches.WithLabelValues("failed", metrics.ReasonParse).Inc()
+			return &permanentError{fmt.Errorf("annotation %s of pv %s is not a JSON object: %v", PVAnnotation, pv.Name, err)}
+		}
+	}
+	before := make(map[string]interface{}, len(existingAttrs))
+	for k, v := range existingAttrs {
+		before[k] = v
+	}
+	owned := parseOwned(pv)
+	if removed := c.prune(existingAttrs, owned); len(removed) > 0 {
+		glog.V(3).Infof("removing stale attributes %v from pv %s", removed, pv.Name)
+	}
+	// stale attributes are removed regardless of the guards.
+	current := make(map[string]interface{}, len(existingAttrs))
+	for k, v := range existingAttrs {
+		current[k] = v
+	}
+	effective, err := attrs.merge(values, existingAttrs, owned)
+	if err != nil {
+		glog.Warningf("failed to merge attributes into pv %s: %v", pv.Name, err)
+		c.recorder.Eventf(pv, coreV1.EventTypeWarning, EventAttributeConflict, "Rules %v not applied: %v", attrs.Rules, err)
+		metrics.PVPatches.WithLabelValues("failed", metrics.ReasonMergeConflict).Inc()
+		return &permanentError{err}
+	}
+	// the attributes added by the patches, with their rules.
+	added := map[string]string{}
+	for _, p := range attrs.patches {
+		err := c.checkTenantPatch(attrs, p)
+		if err == nil {
+			keys := patchKeys(p.Ops)
+			had := map[string]bool{}
+			for _, k := range keys {
+				_, had[k] = existingAttrs[k]
+			}
+			if err = applyPatch(existingAttrs, p.Ops); err == nil {
+				for _, k := range keys {
+					if _, ok := existingAttrs[k]; ok && !had[k] {
+						added[k] = p.Rule
 					}
 				}
 			}
-			glog.V(3).Infof("updating with new annotation %+v", ann)
-			pv.ObjectMeta.SetAnnotations(ann)
 		}
-		_, err := c.clientset.CoreV1().PersistentVolumes().Update(pv)
 		if err != nil {
-			glog.Warningf("failed to update pv :%v", err)
+			glog.Warningf("failed to apply json patch of rule %s to pv %s: %v", p.Rule, pv.Name, err)
+			c.recorder.Eventf(pv, coreV1.EventTypeWarning, EventPatchFailed, "Rules %v not applied, json patch of rule %s failed: %v", attrs.Rules, p.Rule, err)
+			metrics.PVPatches.WithLabelValues("failed", metrics.ReasonPatch).Inc()
+			return &permanentError{fmt.Errorf("json patch of rule %s failed on pv %s: %v", p.Rule, pv.Name, err)}
 		}
 	}
-}
-
-func (c *Controller) updatePVC(oldPVC, newPVC *coreV1.PersistentVolumeClaim) error {
-	ns := newPVC.Namespace
-	name := newPVC.Name
-
-	if data := c.getPodPVCMap(ns, name); len(data) > 0 {
-		// if pvc is bound and pv exists, update pv annotation
-		if newPVC.Status.Phase == coreV1.ClaimBound {
-			pvName := newPVC.Spec.VolumeName
-			if len(pvName) > 0 {
-				c.updatePVAnnotation(pvName, data)
-				c.updatePodPVCMap(ns, name, "", false /* toAdd */)
-			}
+	if err := c.validatePatched(pv, attrs, existingAttrs); err != nil {
+		glog.Warningf("not applying rules %v to pv %s: %v", attrs.Rules, pv.Name, err)
+		c.recorder.Eventf(pv, coreV1.EventTypeWarning, EventSchemaViolation, "Rules %v not applied: %v", attrs.Rules, err)
+		metrics.PVPatches.WithLabelValues("failed", metrics.ReasonSchema).Inc()
+		return &permanentError{err}
+	}
+	// pods are rejected at admission already, but the PV may have changed
+	// since.
+	if err := c.getGuards(pvc.Namespace).checkAll(attrs, current, existingAttrs); err != nil {
+		glog.Warningf("not applying rules %v to pv %s: %v", attrs.Rules, pv.Name, err)
+		c.recorder.Eventf(pv, coreV1.EventTypeWarning, EventProtectedAttribute, "Rules %v not applied: %v", attrs.Rules, err)
+		metrics.PVPatches.WithLabelValues("failed", metrics.ReasonProtected).Inc()
+		return &permanentError{err}
+	}
+	newAnn, err := json.Marshal(existingAttrs)
+	if err != nil {
+		glog.Warningf("failed to encode attributes of pv %s: %v", pv.Name, err)
+		metrics.PVPatches.WithLabelValues("failed", metrics.ReasonParse).Inc()
+		return &permanentError{fmt.Errorf("failed to encode attributes of pv %s: %v", pv.Name, err)}
+	}
+	ann[PVAnnotation] = string(newAnn)
+	for k, e := range effective {
+		if _, ok := existingAttrs[k]; !ok {
+			// removed by a json patch.
+			delete(effective, k)
+			continue
 		}
+		e.Value = attrs.redactValue(k, e.Value)
+		effective[k] = e
 	}
-
+	effectiveAnn, _ := json.Marshal(effective)
+	ann[EffectiveAttributesAnnotation] = string(effectiveAnn)
+	ann[PolicyAnnotation] = strings.Join(attrs.Rules, ",")
+	for k, e := range effective {
+		owned[k] = e.Rule
+	}
+	for k, v := range values {
+		if _, ok := effective[k]; !ok && v == nil {
+			delete(owned, k)
+		}
+	}
+	for k, rule := range added {
+		owned[k] = rule
+	}
+	for k := range owned {
+		if _, ok := existingAttrs[k]; !ok {
+			delete(owned, k)
+		}
+	}
+	setOwned(ann, owned)
+	if len(attrs.conflicts) > 0 {
+		conflictsAnn, _ := json.Marshal(attrs.conflicts)
+		ann[ConflictsAnnotation] = string(conflictsAnn)
+	} else {
+		delete(ann, ConflictsAnnotation)
+	}
+	glog.V(3).Infof("updating pv %s with rules %v", pv.Name, attrs.Rules)
+	pv.ObjectMeta.SetAnnotations(ann)
+	if err := c.updatePV(pv, oldAnn, specChanges); err != nil {
+		if apierrors.IsConflict(err) {
+			c.recorder.Eventf(pv, coreV1.EventTypeWarning, EventUpdateConflict, "PV changed while applying rules %v, retrying", attrs.Rules)
+			metrics.PVPatches.WithLabelValues("failed", metrics.ReasonConflict).Inc()
+			return &conflictError{fmt.Errorf("failed to update pv %s: %v", pv.Name, err)}
+		}
+		if len(specChanges) > 0 && apierrors.IsInvalid(err) {
+			// the API server doesn't allow to change spec.csi any more.
+			c.recorder.Eventf(pv, coreV1.EventTypeWarning, EventVolumeAttributesFailed, "Rules %v not applied, spec.csi.volumeAttributes can't be changed: %v", attrs.Rules, err)
+			metrics.PVPatches.WithLabelValues("failed", metrics.ReasonVolumeAttributes).Inc()
+			return &permanentError{fmt.Errorf("spec.csi.volumeAttributes of pv %s can't be changed: %v", pv.Name, err)}
+		}
+		c.recorder.Eventf(pv, coreV1.EventTypeWarning, EventUpdateFailed, "Failed to apply rules %v: %v", attrs.Rules, err)
+		metrics.PVPatches.WithLabelValues("failed", metrics.ReasonUpdate).Inc()
+		return fmt.Errorf("failed to update pv %s: %v", pv.Name, err)
+	}
+	metrics.PVPatches.WithLabelValues("succeeded", "").Inc()
+	changes := attrs.describeChanges(before, existingAttrs)
+	if len(specChanges) > 0 {
+		changes += "; " + attrs.describeSpecChanges(specChanges)
+	}
+	c.recorder.Eventf(pv, coreV1.EventTypeNormal, EventAttributesApplied, "Applied rules %v for claim %s/%s: %s", attrs.Rules, pvc.Namespace, pvc.Name, changes)
 	return nil
 }
 
-func (c *Controller) updatePodPVCMap(pvcNS, pvcName, attr string, toAdd bool) {
+// renderValues renders the templated attribute values for a PV.
+func (c *Controller) renderValues(attrs *Attributes, pvc *coreV1.PersistentVolumeClaim, pv *coreV1.PersistentVolume) (map[string]interface{}, error) {
+	templated := false
+	for _, v := range attrs.Values {
+		templated = templated || isTemplate(v)
+	}
+	if !templated {
+		return attrs.Values, nil
+	}
+	ns, err := c.getNamespace(pvc.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	return renderValues(attrs.Values, newTemplateData(attrs.pod, pvc, pv, ns))
+}
+
+func (c *Controller) updatePodPVCMap(pvcNS, pvcName string, attrs *Attributes, toAdd bool) {
 	c.podPVCLock.Lock()
 	defer c.podPVCLock.Unlock()
 	key := pvcNS + "/" + pvcName
-	glog.V(5).Infof("updating map: %s/%s with %s %v", pvcNS, pvcName, attr, toAdd)
+	glog.V(5).Infof("updating map: %s/%s %v", pvcNS, pvcName, toAdd)
 	if toAdd {
-		c.podPVCMap[key] = attr
+		c.podPVCMap[key] = attrs
 	} else {
 		delete(c.podPVCMap, key)
 	}
+	metrics.PendingPVCs.Set(float64(len(c.podPVCMap)))
 }
 
-func (c *Controller) getPodPVCMap(pvcNS, pvcName string) string {
+// clearPodPVCMap removes the attributes of a claim once they are applied,
+// unless a pod admitted meanwhile replaced them.
+func (c *Controller) clearPodPVCMap(pvcNS, pvcName string, attrs *Attributes) {
 	c.podPVCLock.Lock()
 	defer c.podPVCLock.Unlock()
 	key := pvcNS + "/" + pvcName
-	glog.V(5).Infof("get map: %s/%s", pvcNS, pvcName)
-	val, ok := c.podPVCMap[key]
-	if ok {
-		return val
+	if c.podPVCMap[key] == attrs {
+		delete(c.podPVCMap, key)
 	}
-	return ""
+	metrics.PendingPVCs.Set(float64(len(c.podPVCMap)))
 }
 
-func (c *Controller) getAttributes(app string) string {
-	for _, conf := range *c.config {
-		if conf.Label == app {
-			return conf.Attributes
-		}
-	}
-	return ""
+func (c *Controller) setRunning(running bool) {
+	c.podPVCLock.Lock()
+	defer c.podPVCLock.Unlock()
+	c.running = running
+}
+
+func (c *Controller) isRunning() bool {
+	c.podPVCLock.Lock()
+	defer c.podPVCLock.Unlock()
+	return c.running
+}
+
+func (c *Controller) getPodPVCMap(pvcNS, pvcName string) *Attributes {
+	c.podPVCLock.Lock()
+	defer c.podPVCLock.Unlock()
+	key := pvcNS + "/" + pvcName
+	glog.V(5).Infof("get map: %s/%s", pvcNS, pvcName)
+	return c.podPVCMap[key]
 }
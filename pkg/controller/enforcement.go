@@ -0,0 +1,273 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/k8s-storage/dumbledore/pkg/metrics"
+
+	coreV1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+type Enforcement string
+
+const (
+	// EnforcementBestEffort admits the pod right away and applies the
+	// attributes in the background. It is the default.
+	EnforcementBestEffort Enforcement = "best-effort"
+	// EnforcementStrict admits the pod only once the PVs of its claims carry
+	// the attributes of the rule.
+	EnforcementStrict Enforcement = "strict"
+)
+
+type FailurePolicy string
+
+const (
+	// FailOpen admits the pod anyway.
+	FailOpen FailurePolicy = "fail-open"
+	// FailClosed rejects the pod, or keeps it uninitialized.
+	FailClosed FailurePolicy = "fail-closed"
+)
+
+var (
+	// EnforcementTimeout is how long a pod matched by a strict or fail-closed
+	// rule waits for the attributes.
+	EnforcementTimeout = 10 * time.Second
+	// EnforcementFailurePolicy is the failure policy of strict rules without
+	// one, other rules fail open by default.
+	EnforcementFailurePolicy = FailClosed
+)
+
+// enforcementPollInterval is how often the PVs are checked while a pod waits.
+const enforcementPollInterval = 500 * time.Millisecond
+
+// Admission is the outcome of AdmitPod for a pod matched by rules.
+//
+// A pod matched by a strict rule waits until the PVs of all its claims carry
+// the attributes of the rule. A pod matched by a fail-closed rule waits for
+// the outcome on the claims that are bound, the claims that are not are
+// applied once they are. If the attributes of a fail-closed rule can't be
+// applied, or are not applied in time, the pod is rejected.
+type Admission struct {
+	c      *Controller
+	pod    *coreV1.Pod
+	attrs  *Attributes
+	claims []string
+	// err is a failure while admitting the pod, it is only set if the pod
+	// fails closed.
+	err error
+	// conflict rejects the pod regardless of the failure policy, e.g. a
+	// conflict with another pod sharing a claim.
+	conflict error
+	// start is when the pod was admitted, earlier failures recorded on the
+	// claims are ignored.
+	start time.Time
+	// outcome is set once the result of the enforcement is recorded.
+	outcome string
+}
+
+// blocks tells whether the pod has to wait for its attributes.
+func (a *Admission) blocks() bool {
+	return a != nil && (a.err != nil || a.conflict != nil || len(a.attrs.waitRules()) > 0 && len(a.claims) > 0)
+}
+
+// Enforce waits until the PVs of the pod's claims carry the attributes of the
+// strict and fail-closed rules. If they don't within the timeout, or can't be
+// applied, it returns an error if the pod must be rejected. Pods whose
+// attributes conflict with those of other pods sharing a claim are rejected
+// if ClaimConflicts says so.
+func (a *Admission) Enforce(timeout time.Duration) error {
+	if !a.blocks() {
+		return nil
+	}
+	if a.conflict != nil {
+		return a.conflict
+	}
+	if a.err != nil {
+		return a.fail(EventEnforcementFailed, a.err)
+	}
+	var reason string
+	var failure error
+	err := wait.PollImmediate(enforcementPollInterval, timeout, func() (bool, error) {
+		reason, failure = a.check()
+		return failure != nil || len(reason) == 0, nil
+	})
+	switch {
+	case failure != nil:
+		return a.fail(EventEnforcementFailed, failure)
+	case err != nil:
+		return a.fail(EventEnforcementTimeout, fmt.Errorf("rules %v not enforced in time: %s", a.attrs.waitRules(), reason))
+	}
+	a.enforced()
+	return nil
+}
+
+// check returns why the attributes are not on the PVs yet, or "" if they
+// are. It returns an error if they can't be applied. The claims and PVs are
+// read from the caches of the leader, the API server is only asked on a miss
+// or by the other replicas.
+func (a *Admission) check() (string, error) {
+	if a.err != nil {
+		return "", a.err
+	}
+	c := a.c
+	rules := a.attrs.waitRules()
+	strict := len(a.attrs.strictRules()) > 0
+	for _, name := range a.claims {
+		pvc, err := c.getPVC(a.pod.Namespace, name)
+		if apierrors.IsNotFound(err) && !strict {
+			continue
+		}
+		if err != nil {
+			return fmt.Sprintf("failed to get claim %s: %v", name, err), nil
+		}
+		if failure, ok := parseFailure(pvc); ok && !failure.Time.Before(a.start) && a.attrs.waitsFor(failure.Rules) {
+			return "", fmt.Errorf("rules %v not applied to claim %s: %s", failure.Rules, name, failure.Message)
+		}
+		if pvc.Status.Phase != coreV1.ClaimBound {
+			if !strict {
+				continue
+			}
+			return fmt.Sprintf("claim %s is not bound", name), nil
+		}
+		if _, ok := pvc.Annotations[PendingAttributesAnnotation]; ok || c.getPodPVCMap(a.pod.Namespace, name) != nil {
+			return fmt.Sprintf("attributes of claim %s are pending", name), nil
+		}
+		pv, err := c.getPV(pvc.Spec.VolumeName)
+		if err != nil {
+			return fmt.Sprintf("failed to get pv %s: %v", pvc.Spec.VolumeName, err), nil
+		}
+		applied := map[string]bool{}
+		for _, rule := range strings.Split(pv.Annotations[PolicyAnnotation], ",") {
+			applied[rule] = true
+		}
+		for _, rule := range rules {
+			if ok, _ := c.inScope(rule, pv); ok && !applied[rule] {
+				return fmt.Sprintf("rule %s is not applied to pv %s", rule, pv.Name), nil
+			}
+		}
+		values := map[string]interface{}{}
+		json.Unmarshal([]byte(pv.Annotations[PVAnnotation]), &values)
+		for k, rule := range a.attrs.Sources {
+			if a.attrs.Values[k] == nil || a.attrs.targets[k] == TargetSpec {
+				// removed by the rule, or not in the annotation.
+				continue
+			}
+			if ok, _ := c.inScope(rule, pv); !ok {
+				continue
+			}
+			if _, ok := values[k]; !ok && a.attrs.waitsFor([]string{rule}) {
+				return fmt.Sprintf("attribute %s of rule %s is missing on pv %s", k, rule, pv.Name), nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// FailurePolicy returns what happens to the pod if the attributes can't be
+// applied in time. A pod fails closed if any rule matching it does.
+func (a *Admission) FailurePolicy() FailurePolicy {
+	if a.attrs.failsClosed() {
+		return FailClosed
+	}
+	return FailOpen
+}
+
+func (a *Admission) enforced() {
+	if len(a.outcome) > 0 {
+		return
+	}
+	a.outcome = "enforced"
+	metrics.Enforcements.WithLabelValues(a.outcome).Inc()
+	glog.V(3).Infof("rules %v enforced for pod %s/%s", a.attrs.waitRules(), a.pod.Namespace, podName(a.pod))
+}
+
+// fail records that the attributes are not applied and returns err if the pod
+// must not be admitted. The event is recorded once.
+func (a *Admission) fail(reason string, err error) error {
+	result := "failed"
+	if reason == EventEnforcementTimeout {
+		result = "timeout"
+	}
+	if a.FailurePolicy() == FailOpen {
+		if len(a.outcome) == 0 {
+			a.outcome = result + "_allowed"
+			metrics.Enforcements.WithLabelValues(a.outcome).Inc()
+			a.c.recordPodEvent(a.pod, coreV1.EventTypeWarning, reason, "Admitted although %v", err)
+		}
+		return nil
+	}
+	if len(a.outcome) == 0 {
+		a.outcome = result + "_rejected"
+		metrics.Enforcements.WithLabelValues(a.outcome).Inc()
+		a.c.recordPodEvent(a.pod, coreV1.EventTypeWarning, reason, "Not admitted: %v", err)
+	}
+	return err
+}
+
+// strictRules returns the names of the matching strict rules in merge
+// order.
+func (a *Attributes) strictRules() []string {
+	if a == nil {
+		return nil
+	}
+	var rules []string
+	for _, rule := range a.Rules {
+		if a.strict[rule] {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// waitRules returns the names of the matching rules the pod waits for, the
+// strict and fail-closed rules, in merge order.
+func (a *Attributes) waitRules() []string {
+	if a == nil {
+		return nil
+	}
+	var rules []string
+	for _, rule := range a.Rules {
+		if a.strict[rule] || a.failClosed[rule] {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// waitsFor tells whether the pod waits for any of the rules.
+func (a *Attributes) waitsFor(rules []string) bool {
+	for _, rule := range rules {
+		if a.strict[rule] || a.failClosed[rule] {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *Attributes) failsClosed() bool {
+	return a != nil && len(a.failClosed) > 0
+}
+
+func (conf *Config) enforcement() Enforcement {
+	if len(conf.Enforcement) == 0 {
+		return EnforcementBestEffort
+	}
+	return conf.Enforcement
+}
+
+func (conf *Config) failurePolicy() FailurePolicy {
+	switch {
+	case len(conf.FailurePolicy) > 0:
+		return conf.FailurePolicy
+	case conf.enforcement() == EnforcementStrict:
+		return EnforcementFailurePolicy
+	}
+	return FailOpen
+}
@@ -0,0 +1,108 @@
+package controller
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedCoreV1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const eventComponent = "dumbledore"
+
+// Reasons of the recorded events.
+const (
+	// on pods
+	EventRuleMatched        = "RuleMatched"
+	EventNoRuleMatched      = "NoRuleMatched"
+	EventRuleConflict       = "RuleConflict"
+	EventClaimNotFound      = "ClaimNotFound"
+	EventEnforcementTimeout = "EnforcementTimeout"
+	EventEnforcementFailed  = "EnforcementFailed"
+	EventClaimConflict      = "ClaimConflict"
+	// on pods and PVs
+	EventProtectedAttribute = "ProtectedAttribute"
+	// on claims
+	EventDeferred            = "Deferred"
+	EventRuleSkipped         = "RuleSkipped"
+	EventRenderFailed        = "RenderFailed"
+	EventKeyGenerationFailed = "KeyGenerationFailed"
+	EventSecretResolveFailed = "SecretResolveFailed"
+	EventClaimMutated        = "ClaimMutated"
+	// on PVs
+	EventAttributesApplied         = "AttributesApplied"
+	EventAttributesRemoved         = "AttributesRemoved"
+	EventInvalidAttributes         = "InvalidAttributes"
+	EventAttributeConflict         = "AttributeConflict"
+	EventPatchFailed               = "PatchFailed"
+	EventSchemaViolation           = "SchemaViolation"
+	EventVolumeAttributesFailed    = "VolumeAttributesFailed"
+	EventVolumeAttributesImmutable = "VolumeAttributesImmutable"
+	EventUpdateConflict            = "UpdateConflict"
+	EventUpdateFailed              = "UpdateFailed"
+)
+
+// newEventRecorder returns a recorder that creates the Events in the
+// background, so that recording an event never delays the admission of a
+// pod. Similar events are aggregated and rate limited. Events of cluster
+// scoped objects like PVs go to the default namespace.
+func newEventRecorder(clientset *kubernetes.Clientset) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartLogging(glog.V(3).Infof)
+	broadcaster.StartRecordingToSink(&typedCoreV1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, coreV1.EventSource{Component: eventComponent})
+}
+
+// Recorder returns the recorder of the controller's Events.
+func (c *Controller) Recorder() record.EventRecorder {
+	return c.recorder
+}
+
+// podEventTarget returns the object to record events of a pod on. Pods
+// created by controllers have no name while they are admitted, their events
+// go to the controller instead. It returns nil if there is none.
+func podEventTarget(pod *coreV1.Pod) runtime.Object {
+	if pod == nil {
+		return nil
+	}
+	if len(pod.Name) > 0 {
+		return pod
+	}
+	if owner := metaV1.GetControllerOf(pod); owner != nil {
+		return &coreV1.ObjectReference{
+			APIVersion: owner.APIVersion,
+			Kind:       owner.Kind,
+			Namespace:  pod.Namespace,
+			Name:       owner.Name,
+			UID:        owner.UID,
+		}
+	}
+	return nil
+}
+
+// recordPodEvent records an event of a pod, see podEventTarget.
+func (c *Controller) recordPodEvent(pod *coreV1.Pod, eventType, reason, messageFmt string, args ...interface{}) {
+	target := podEventTarget(pod)
+	if target == nil {
+		glog.V(3).Infof("no object to record event %s of pod %s/%s on", reason, pod.Namespace, podName(pod))
+		return
+	}
+	message := fmt.Sprintf(messageFmt, args...)
+	if len(pod.Name) == 0 {
+		message = fmt.Sprintf("Pod %s: %s", podName(pod), message)
+	}
+	c.recorder.Event(target, eventType, reason, message)
+}
+
+func podName(pod *coreV1.Pod) string {
+	if len(pod.Name) > 0 {
+		return pod.Name
+	}
+	return pod.GenerateName
+}
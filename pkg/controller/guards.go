@@ -0,0 +1,108 @@
+package controller
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/k8s-storage/dumbledore/pkg/metrics"
+)
+
+// MonotonicAttribute is an attribute whose value may only move forward in
+// Values, e.g. ["disabled", "enabled"] allows to enable but not to disable.
+type MonotonicAttribute struct {
+	Attribute string   `json:"attribute"`
+	Values    []string `json:"values"`
+}
+
+// guards are the protected attributes declared by the rules of a namespace.
+type guards struct {
+	// immutable maps attributes to the rule declaring them.
+	immutable map[string]string
+	// monotonic maps attributes to the rules declaring them and their order.
+	monotonic map[string]map[string][]string
+}
+
+// getGuards collects the protected attributes of the cluster rules and of
+// the rules of the namespace. They protect the attribute regardless of the
+// rule that sets it.
+func (c *Controller) getGuards(namespace string) *guards {
+	g := &guards{
+		immutable: map[string]string{},
+		monotonic: map[string]map[string][]string{},
+	}
+	for _, conf := range c.getConfig() {
+		if len(conf.Namespace) > 0 && conf.Namespace != namespace {
+			continue
+		}
+		for _, attr := range conf.Immutable {
+			g.immutable[attr] = conf.Name
+		}
+		for _, attr := range conf.Monotonic {
+			if g.monotonic[attr.Attribute] == nil {
+				g.monotonic[attr.Attribute] = map[string][]string{}
+			}
+			g.monotonic[attr.Attribute][conf.Name] = attr.Values
+		}
+	}
+	return g
+}
+
+// check returns an error if changing an attribute from old to v violates a
+// guard, v is nil if the attribute is removed. Values that are not plain are
+// not checked.
+func (g *guards) check(attrs *Attributes, k string, old, v interface{}) error {
+	if !isPlainValue(v) || !isPlainValue(old) || reflect.DeepEqual(old, v) {
+		return nil
+	}
+	if rule, ok := g.immutable[k]; ok {
+		metrics.ProtectedAttributeViolations.WithLabelValues("immutable").Inc()
+		return fmt.Errorf("attribute %s is immutable by rule %s, it is %v already", k, rule, attrs.redactValue(k, old))
+	}
+	for rule, order := range g.monotonic[k] {
+		oldIndex, index := valueIndex(order, old), valueIndex(order, v)
+		if oldIndex >= 0 && index < oldIndex {
+			metrics.ProtectedAttributeViolations.WithLabelValues("monotonic").Inc()
+			if v == nil {
+				return fmt.Errorf("attribute %s can't be removed, it is %v and rule %s only allows the order %v", k, attrs.redactValue(k, old), rule, order)
+			}
+			return fmt.Errorf("attribute %s can't go from %v to %v, rule %s only allows the order %v", k, attrs.redactValue(k, old), attrs.redactValue(k, v), rule, order)
+		}
+	}
+	return nil
+}
+
+// checkAll checks the values against the current ones, the current
+// attributes missing from the values are removed.
+func (g *guards) checkAll(attrs *Attributes, current, values map[string]interface{}) error {
+	for k, old := range current {
+		if err := g.check(attrs, k, old, values[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isStricter tells whether the value a of an attribute comes later than b in
+// the order of a rule declaring it monotonic. ok is false if no rule orders
+// both values.
+func (g *guards) isStricter(k string, a, b interface{}) (stricter bool, ok bool) {
+	for _, order := range g.monotonic[k] {
+		indexA, indexB := valueIndex(order, a), valueIndex(order, b)
+		if indexA >= 0 && indexB >= 0 {
+			return indexA > indexB, true
+		}
+	}
+	return false, false
+}
+
+// valueIndex returns the position of the value in the order, values that
+// are not in it come before all others.
+func valueIndex(order []string, v interface{}) int {
+	s := fmt.Sprint(v)
+	for i, o := range order {
+		if o == s {
+			return i
+		}
+	}
+	return -1
+}
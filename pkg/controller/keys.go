@@ -0,0 +1,125 @@
+package controller
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/golang/glog"
+
+	coreV1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	defaultKeyLength = 32
+	maxKeyLength     = 1024
+)
+
+// GeneratedKey is an attribute whose value is a random key generated for
+// every PV. The key is stored in a Secret owned by the PV, the attribute is
+// set to a reference to it:
+//
+//	{"secretRef": {"namespace": "default", "name": "dumbledore-keys-pv1", "key": "dmcrypt-key"}}
+type GeneratedKey struct {
+	// Attribute is the name of the attribute.
+	Attribute string `json:"attribute"`
+	// Length is the length of the key in bytes, 32 by default. The key is
+	// stored base64 encoded.
+	Length int `json:"length,omitempty"`
+}
+
+// generatedKey is the value of a generated key attribute until it is applied
+// to a PV.
+type generatedKey struct {
+	length int
+}
+
+func keySecretName(pvName string) string {
+	return "dumbledore-keys-" + pvName
+}
+
+func secretRefValue(namespace, name, key string) map[string]interface{} {
+	return map[string]interface{}{
+		"secretRef": map[string]interface{}{
+			"namespace": namespace,
+			"name":      name,
+			"key":       key,
+		},
+	}
+}
+
+// applyGeneratedKeys makes sure the Secret of the PV holds a key for every
+// generated key attribute, and replaces the attributes by references to it.
+// Existing keys are never replaced.
+func (c *Controller) applyGeneratedKeys(pv *coreV1.PersistentVolume, values map[string]interface{}) (map[string]interface{}, error) {
+	keys := map[string]int{}
+	for k, v := range values {
+		if key, ok := v.(generatedKey); ok {
+			keys[k] = key.length
+		}
+	}
+	if len(keys) == 0 {
+		return values, nil
+	}
+
+	secrets := c.clientset.CoreV1().Secrets(KeySecretNamespace)
+	name := keySecretName(pv.Name)
+	secret, err := secrets.Get(name, metaV1.GetOptions{})
+	create := apierrors.IsNotFound(err)
+	if create {
+		secret = &coreV1.Secret{
+			ObjectMeta: metaV1.ObjectMeta{
+				Name:      name,
+				Namespace: KeySecretNamespace,
+				// the Secret is garbage collected with the PV.
+				OwnerReferences: []metaV1.OwnerReference{{
+					APIVersion: "v1",
+					Kind:       "PersistentVolume",
+					Name:       pv.Name,
+					UID:        pv.UID,
+				}},
+			},
+			Type: coreV1.SecretTypeOpaque,
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get secret %s/%s: %v", KeySecretNamespace, name, err)
+	}
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+
+	changed := false
+	for k, length := range keys {
+		if _, ok := secret.Data[k]; ok {
+			continue
+		}
+		key := make([]byte, length)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		secret.Data[k] = []byte(base64.StdEncoding.EncodeToString(key))
+		changed = true
+	}
+	if create {
+		_, err = secrets.Create(secret)
+	} else if changed {
+		_, err = secrets.Update(secret)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to store keys in secret %s/%s: %v", KeySecretNamespace, name, err)
+	}
+	if changed {
+		glog.V(3).Infof("generated keys for pv %s in secret %s/%s", pv.Name, KeySecretNamespace, name)
+	}
+
+	resolved := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		if _, ok := keys[k]; ok {
+			v = secretRefValue(KeySecretNamespace, name, k)
+		}
+		resolved[k] = v
+	}
+	return resolved, nil
+}
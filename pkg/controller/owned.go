@@ -0,0 +1,124 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/golang/glog"
+
+	"github.com/k8s-storage/dumbledore/pkg/metrics"
+
+	coreV1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// LastAppliedAnnotation records on the PV the attributes dumbledore owns,
+// with the rule that set each. Attributes that are not recorded were set by
+// someone else, e.g. the CSI driver or an admin, and are never removed.
+const LastAppliedAnnotation = "dumbledore.k8s-storage.io/last-applied"
+
+// parseOwned returns the attributes owned by dumbledore with their rules. PVs
+// updated before the annotation existed own the attributes last applied.
+func parseOwned(pv *coreV1.PersistentVolume) map[string]string {
+	owned := map[string]string{}
+	data, ok := pv.Annotations[LastAppliedAnnotation]
+	if !ok {
+		effective := map[string]EffectiveAttribute{}
+		json.Unmarshal([]byte(pv.Annotations[EffectiveAttributesAnnotation]), &effective)
+		for k, e := range effective {
+			owned[k] = e.Rule
+		}
+		return owned
+	}
+	if err := json.Unmarshal([]byte(data), &owned); err != nil {
+		glog.Warningf("invalid %s annotation on pv %s: %v", LastAppliedAnnotation, pv.Name, err)
+	}
+	return owned
+}
+
+// staleKeys returns the owned attributes whose rule is gone or no longer
+// sets them, in order. Nothing is stale before the rules are loaded, and
+// the attributes of a rule whose policy is invalid are not stale either.
+func (c *Controller) staleKeys(owned map[string]string) []string {
+	c.configLock.RLock()
+	defer c.configLock.RUnlock()
+	if c.ruleKeys == nil {
+		return nil
+	}
+	var stale []string
+	for k, rule := range owned {
+		if !c.ruleKeys[rule][k] && !c.invalidRules[rule] {
+			stale = append(stale, k)
+		}
+	}
+	sort.Strings(stale)
+	return stale
+}
+
+// prune removes the stale attributes from the attributes on the PV and from
+// the owned ones. It returns the removed attributes.
+func (c *Controller) prune(existing map[string]interface{}, owned map[string]string) []string {
+	stale := c.staleKeys(owned)
+	for _, k := range stale {
+		delete(existing, k)
+		delete(owned, k)
+	}
+	return stale
+}
+
+// setOwned records the owned attributes on the PV annotations.
+func setOwned(ann map[string]string, owned map[string]string) {
+	if len(owned) == 0 {
+		delete(ann, LastAppliedAnnotation)
+		return
+	}
+	data, _ := json.Marshal(owned)
+	ann[LastAppliedAnnotation] = string(data)
+}
+
+// syncPV removes the attributes of rules that were deleted or changed from a
+// PV.
+func (c *Controller) syncPV(name string) error {
+	pv, err := c.clientset.CoreV1().PersistentVolumes().Get(name, metaV1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get pv %s: %v", name, err)
+	}
+	owned := parseOwned(pv)
+	if len(c.staleKeys(owned)) == 0 {
+		return nil
+	}
+	existingAttrs := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(pv.Annotations[PVAnnotation]), &existingAttrs); err != nil {
+		glog.Warningf("failed to parse annotation of pv %s, not removing stale attributes: %v", pv.Name, err)
+		return nil
+	}
+	removed := c.prune(existingAttrs, owned)
+	data, err := json.Marshal(existingAttrs)
+	if err != nil {
+		return err
+	}
+	oldAnn := pv.Annotations
+	pv = pv.DeepCopy()
+	pv.Annotations[PVAnnotation] = string(data)
+	setOwned(pv.Annotations, owned)
+	effective := map[string]EffectiveAttribute{}
+	if err := json.Unmarshal([]byte(pv.Annotations[EffectiveAttributesAnnotation]), &effective); err == nil {
+		for _, k := range removed {
+			delete(effective, k)
+		}
+		effectiveAnn, _ := json.Marshal(effective)
+		pv.Annotations[EffectiveAttributesAnnotation] = string(effectiveAnn)
+	}
+	if err := c.updatePV(pv, oldAnn, nil); err != nil {
+		return fmt.Errorf("failed to update pv %s: %v", pv.Name, err)
+	}
+	glog.V(3).Infof("removed stale attributes %v from pv %s", removed, pv.Name)
+	metrics.PrunedAttributes.Add(float64(len(removed)))
+	c.recorder.Eventf(pv, coreV1.EventTypeNormal, EventAttributesRemoved, "Removed attributes %v, their rules no longer set them", removed)
+	return nil
+}
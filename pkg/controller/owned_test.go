@@ -0,0 +1,35 @@
+package controller
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestStaleKeys(t *testing.T) {
+	c := &Controller{configLock: &sync.RWMutex{}}
+	if stale := c.staleKeys(map[string]string{"a": "gone"}); stale != nil {
+		t.Errorf("stale keys before the rules are loaded = %v, want none", stale)
+	}
+	c.setConfig([]Config{
+		{Name: "replication", Attributes: `{"replicas": 3}`},
+		// the last valid version of an invalid policy.
+		{Name: "encryption", Attributes: `{"cipher": "aes"}`},
+	}, map[string]error{
+		"encryption": errors.New("invalid selector"),
+		"backup":     errors.New("invalid selector"),
+	})
+	owned := map[string]string{
+		"replicas": "replication",
+		"mode":     "replication",
+		"cipher":   "encryption",
+		"dmcrypt":  "encryption",
+		"schedule": "backup",
+		"tier":     "gone",
+	}
+	want := []string{"mode", "tier"}
+	if stale := c.staleKeys(owned); !reflect.DeepEqual(stale, want) {
+		t.Errorf("staleKeys(%v) = %v, want %v", owned, stale, want)
+	}
+}
@@ -0,0 +1,353 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// PatchOperation is an RFC 6902 JSON Patch operation on the attributes of a
+// PV. Paths are JSON pointers into the attributes, e.g.
+// /replication/factor.
+type PatchOperation struct {
+	// Op is add, remove, replace, move, copy or test.
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	// From is the source of move and copy.
+	From string `json:"from,omitempty"`
+	// Value is the value of add, replace and test.
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// rulePatch are the JSON Patch operations of a rule.
+type rulePatch struct {
+	Rule string           `json:"rule"`
+	Ops  []PatchOperation `json:"ops"`
+}
+
+// mergePatch applies the RFC 7396 JSON Merge Patch to the target and returns
+// the result, the target is not changed. Objects are merged recursively and
+// null deletes a key. With keepNulls the nulls of the patch are kept instead,
+// to combine two patches into one.
+func mergePatch(target, patch interface{}, keepNulls bool) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	merged := map[string]interface{}{}
+	if t, ok := target.(map[string]interface{}); ok {
+		for k, v := range t {
+			merged[k] = v
+		}
+	}
+	for k, v := range p {
+		switch {
+		case v != nil:
+			merged[k] = mergePatch(merged[k], v, keepNulls)
+		case keepNulls:
+			merged[k] = nil
+		default:
+			delete(merged, k)
+		}
+	}
+	return merged
+}
+
+// validatePatch checks the operations of a rule.
+func validatePatch(ops []PatchOperation) error {
+	for i, op := range ops {
+		path, err := parsePointer(op.Path)
+		if err != nil {
+			return fmt.Errorf("operation %d: %v", i, err)
+		}
+		if len(path) == 0 {
+			return fmt.Errorf("operation %d: path must not be empty", i)
+		}
+		switch op.Op {
+		case "add", "replace", "test":
+			var v interface{}
+			if len(op.Value) == 0 {
+				return fmt.Errorf("operation %d: %s without value", i, op.Op)
+			}
+			if err := json.Unmarshal(op.Value, &v); err != nil {
+				return fmt.Errorf("operation %d: invalid value: %v", i, err)
+			}
+		case "remove":
+		case "move", "copy":
+			from, err := parsePointer(op.From)
+			if err != nil {
+				return fmt.Errorf("operation %d: %v", i, err)
+			}
+			if len(from) == 0 {
+				return fmt.Errorf("operation %d: from must not be empty", i)
+			}
+			if op.Op == "move" && strings.HasPrefix(op.Path+"/", op.From+"/") && op.Path != op.From {
+				return fmt.Errorf("operation %d: can't move %s into itself", i, op.From)
+			}
+		default:
+			return fmt.Errorf("operation %d: unknown op %q", i, op.Op)
+		}
+	}
+	return nil
+}
+
+// patchKeys returns the attributes the operations change.
+func patchKeys(ops []PatchOperation) []string {
+	var keys []string
+	for _, op := range ops {
+		for _, p := range []string{op.Path, op.From} {
+			if path, err := parsePointer(p); err == nil && len(path) > 0 {
+				keys = append(keys, path[0])
+			}
+		}
+	}
+	return keys
+}
+
+// checkTenantPatch returns an error if the JSON patch of a namespaced rule
+// changes an attribute that no namespaced rule sets, tenants can't change the
+// attributes of cluster rules or of the driver.
+func (c *Controller) checkTenantPatch(attrs *Attributes, p rulePatch) error {
+	if conf := c.getRule(p.Rule); conf == nil || len(conf.Namespace) == 0 {
+		return nil
+	}
+	for _, k := range patchKeys(p.Ops) {
+		source, ok := attrs.Sources[k]
+		if conf := c.getRule(source); !ok || conf == nil || len(conf.Namespace) == 0 {
+			return fmt.Errorf("rule %s can't change %s, it is not set by a namespaced rule", p.Rule, k)
+		}
+	}
+	return nil
+}
+
+// applyPatch applies the RFC 6902 JSON Patch operations to the attributes in
+// place. Either all operations are applied or none.
+func applyPatch(attrs map[string]interface{}, ops []PatchOperation) error {
+	var doc interface{}
+	// work on a copy, the attributes are left alone if an operation fails.
+	data, err := json.Marshal(attrs)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	for _, op := range ops {
+		if doc, err = applyOperation(doc, op); err != nil {
+			return fmt.Errorf("%s %s: %v", op.Op, op.Path, err)
+		}
+	}
+	patched, ok := doc.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("the attributes must be a JSON object, not %s", mustMarshal(doc))
+	}
+	for k := range attrs {
+		delete(attrs, k)
+	}
+	for k, v := range patched {
+		attrs[k] = v
+	}
+	return nil
+}
+
+func applyOperation(doc interface{}, op PatchOperation) (interface{}, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+	if len(path) == 0 {
+		return nil, fmt.Errorf("path must not be empty")
+	}
+	var value interface{}
+	if len(op.Value) > 0 {
+		if err := json.Unmarshal(op.Value, &value); err != nil {
+			return nil, err
+		}
+	}
+	switch op.Op {
+	case "add":
+		return addValue(doc, path, value)
+	case "remove":
+		doc, _, err := removeValue(doc, path)
+		return doc, err
+	case "replace":
+		if doc, _, err = removeValue(doc, path); err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, value)
+	case "move", "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "move" {
+			if doc, value, err = removeValue(doc, from); err != nil {
+				return nil, err
+			}
+		} else if value, err = getValue(doc, from); err != nil {
+			return nil, err
+		} else {
+			// the copy must not share objects with the source.
+			json.Unmarshal([]byte(mustMarshal(value)), &value)
+		}
+		return addValue(doc, path, value)
+	case "test":
+		current, err := getValue(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(current, value) {
+			return nil, fmt.Errorf("value is %s", mustMarshal(current))
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("unknown op %q", op.Op)
+}
+
+// parsePointer splits an RFC 6901 JSON pointer into its unescaped tokens.
+func parsePointer(pointer string) ([]string, error) {
+	if len(pointer) == 0 {
+		return nil, nil
+	}
+	if pointer[0] != '/' {
+		return nil, fmt.Errorf("path %q must start with /", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(t, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+func getValue(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch container := doc.(type) {
+		case map[string]interface{}:
+			v, ok := container[token]
+			if !ok {
+				return nil, fmt.Errorf("%s not found", token)
+			}
+			doc = v
+		case []interface{}:
+			i, err := arrayIndex(token, len(container)-1)
+			if err != nil {
+				return nil, err
+			}
+			doc = container[i]
+		default:
+			return nil, fmt.Errorf("%s not found", token)
+		}
+	}
+	return doc, nil
+}
+
+// addValue adds the value at the path and returns the changed document.
+func addValue(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	token := path[0]
+	switch container := doc.(type) {
+	case map[string]interface{}:
+		if len(path) == 1 {
+			container[token] = value
+			return container, nil
+		}
+		child, ok := container[token]
+		if !ok {
+			return nil, fmt.Errorf("%s not found", token)
+		}
+		child, err := addValue(child, path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		container[token] = child
+		return container, nil
+	case []interface{}:
+		if len(path) == 1 {
+			if token == "-" {
+				return append(container, value), nil
+			}
+			i, err := arrayIndex(token, len(container))
+			if err != nil {
+				return nil, err
+			}
+			container = append(container, nil)
+			copy(container[i+1:], container[i:])
+			container[i] = value
+			return container, nil
+		}
+		i, err := arrayIndex(token, len(container)-1)
+		if err != nil {
+			return nil, err
+		}
+		child, err := addValue(container[i], path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		container[i] = child
+		return container, nil
+	}
+	return nil, fmt.Errorf("%s not found", token)
+}
+
+// removeValue removes the value at the path and returns the changed document
+// and the removed value.
+func removeValue(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, fmt.Errorf("can't remove the attributes")
+	}
+	token := path[0]
+	switch container := doc.(type) {
+	case map[string]interface{}:
+		child, ok := container[token]
+		if !ok {
+			return nil, nil, fmt.Errorf("%s not found", token)
+		}
+		if len(path) == 1 {
+			delete(container, token)
+			return container, child, nil
+		}
+		child, removed, err := removeValue(child, path[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		container[token] = child
+		return container, removed, nil
+	case []interface{}:
+		i, err := arrayIndex(token, len(container)-1)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(path) == 1 {
+			removed := container[i]
+			return append(container[:i], container[i+1:]...), removed, nil
+		}
+		child, removed, err := removeValue(container[i], path[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		container[i] = child
+		return container, removed, nil
+	}
+	return nil, nil, fmt.Errorf("%s not found", token)
+}
+
+// arrayIndex parses an array index of at most max.
+func arrayIndex(token string, max int) (int, error) {
+	i, err := strconv.Atoi(token)
+	if err != nil || token[0] < '0' || token[0] > '9' || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %s", token)
+	}
+	if i > max {
+		return 0, fmt.Errorf("array index %d out of bounds", i)
+	}
+	return i, nil
+}
+
+func mustMarshal(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
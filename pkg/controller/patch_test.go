@@ -0,0 +1,126 @@
+package controller
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		target    string
+		patch     string
+		keepNulls bool
+		want      string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, false, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, false, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, false, `{}`},
+		{`{"a":"b"}`, `{"a":null}`, true, `{"a":null}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, false, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, false, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, false, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, false, `{"a":{"b":"d"}}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"c":null}}`, true, `{"a":{"b":"c","c":null}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, false, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, false, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, false, `["c"]`},
+		{`{"a":"foo"}`, `null`, false, `null`},
+		{`{"e":null}`, `{"a":1}`, false, `{"a":1,"e":null}`},
+		{`[1,2]`, `{"a":"b","c":null}`, false, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, false, `{"a":{"bb":{}}}`},
+	}
+	for _, test := range tests {
+		var target, patch interface{}
+		json.Unmarshal([]byte(test.target), &target)
+		json.Unmarshal([]byte(test.patch), &patch)
+		if got := mustMarshal(mergePatch(target, patch, test.keepNulls)); got != test.want {
+			t.Errorf("mergePatch(%s, %s, %v) = %s, want %s", test.target, test.patch, test.keepNulls, got, test.want)
+		}
+	}
+}
+
+func TestApplyPatch(t *testing.T) {
+	tests := []struct {
+		attrs string
+		ops   string
+		want  string
+		err   string
+	}{
+		{`{"a":"b"}`, `[{"op":"add","path":"/c","value":"d"}]`, `{"a":"b","c":"d"}`, ""},
+		{`{"a":"b"}`, `[{"op":"add","path":"/a","value":"d"}]`, `{"a":"d"}`, ""},
+		{`{"a":{"b":[1,3]}}`, `[{"op":"add","path":"/a/b/1","value":2}]`, `{"a":{"b":[1,2,3]}}`, ""},
+		{`{"a":{"b":[1]}}`, `[{"op":"add","path":"/a/b/-","value":2}]`, `{"a":{"b":[1,2]}}`, ""},
+		{`{"a":{"b":[1]}}`, `[{"op":"add","path":"/a/b/2","value":2}]`, `{"a":{"b":[1]}}`, "out of bounds"},
+		{`{"a":{"b":[1]}}`, `[{"op":"add","path":"/a/b/01","value":2}]`, `{"a":{"b":[1]}}`, "invalid array index"},
+		{`{"a":"b"}`, `[{"op":"add","path":"/c/d","value":1}]`, `{"a":"b"}`, "not found"},
+		{`{"a":"b","c":"d"}`, `[{"op":"remove","path":"/a"}]`, `{"c":"d"}`, ""},
+		{`{"a":[1,2,3]}`, `[{"op":"remove","path":"/a/1"}]`, `{"a":[1,3]}`, ""},
+		{`{"a":"b"}`, `[{"op":"remove","path":"/c"}]`, `{"a":"b"}`, "not found"},
+		{`{"a":"b"}`, `[{"op":"replace","path":"/a","value":"c"}]`, `{"a":"c"}`, ""},
+		{`{"a":"b"}`, `[{"op":"replace","path":"/c","value":"d"}]`, `{"a":"b"}`, "not found"},
+		{`{"a":{"b":"c"}}`, `[{"op":"move","from":"/a/b","path":"/d"}]`, `{"a":{},"d":"c"}`, ""},
+		{`{"a":{"b":"c"}}`, `[{"op":"copy","from":"/a","path":"/d"},{"op":"add","path":"/d/b","value":"e"}]`, `{"a":{"b":"c"},"d":{"b":"e"}}`, ""},
+		{`{"a":"b"}`, `[{"op":"test","path":"/a","value":"b"},{"op":"add","path":"/c","value":1}]`, `{"a":"b","c":1}`, ""},
+		{`{"a":"b"}`, `[{"op":"add","path":"/c","value":1},{"op":"test","path":"/a","value":"c"}]`, `{"a":"b"}`, `value is "b"`},
+		{`{"a/b":1,"c~d":2}`, `[{"op":"remove","path":"/a~1b"},{"op":"replace","path":"/c~0d","value":3}]`, `{"c~d":3}`, ""},
+		{`{"a":"b"}`, `[{"op":"add","path":"","value":"c"}]`, `{"a":"b"}`, "path must not be empty"},
+		{`{"a":"b"}`, `[{"op":"replace","path":"","value":{"c":"d"}}]`, `{"a":"b"}`, "path must not be empty"},
+		{`{"a":"b"}`, `[{"op":"remove","path":""}]`, `{"a":"b"}`, "path must not be empty"},
+		{`{"a":"b"}`, `[{"op":"add","path":"a","value":"c"}]`, `{"a":"b"}`, "must start with /"},
+		{`{"a":"b"}`, `[{"op":"drop","path":"/a"}]`, `{"a":"b"}`, "unknown op"},
+	}
+	for _, test := range tests {
+		attrs := map[string]interface{}{}
+		var ops []PatchOperation
+		json.Unmarshal([]byte(test.attrs), &attrs)
+		if err := json.Unmarshal([]byte(test.ops), &ops); err != nil {
+			t.Fatalf("invalid operations %s: %v", test.ops, err)
+		}
+		err := applyPatch(attrs, ops)
+		switch {
+		case len(test.err) > 0:
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("applying %s to %s: got error %v, want %q", test.ops, test.attrs, err, test.err)
+			}
+		case err != nil:
+			t.Errorf("applying %s to %s: %v", test.ops, test.attrs, err)
+		}
+		if got := mustMarshal(attrs); got != test.want {
+			t.Errorf("applying %s to %s = %s, want %s", test.ops, test.attrs, got, test.want)
+		}
+	}
+}
+
+func TestParsePointer(t *testing.T) {
+	tests := []struct {
+		pointer string
+		want    []string
+		err     bool
+	}{
+		{"", nil, false},
+		{"/", []string{""}, false},
+		{"/a", []string{"a"}, false},
+		{"/a/b/0", []string{"a", "b", "0"}, false},
+		{"/a~1b", []string{"a/b"}, false},
+		{"/m~0n", []string{"m~n"}, false},
+		{"/~01", []string{"~1"}, false},
+		{"/a//b", []string{"a", "", "b"}, false},
+		{"a", nil, true},
+		{"#/a", nil, true},
+	}
+	for _, test := range tests {
+		got, err := parsePointer(test.pointer)
+		switch {
+		case test.err:
+			if err == nil {
+				t.Errorf("parsePointer(%q) = %q, want an error", test.pointer, got)
+			}
+		case err != nil:
+			t.Errorf("parsePointer(%q): %v", test.pointer, err)
+		case !reflect.DeepEqual(got, test.want):
+			t.Errorf("parsePointer(%q) = %q, want %q", test.pointer, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+
+	coreV1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// PendingAttributesAnnotation records on a claim that is not bound yet the
+// attributes to apply to its PV, so that they survive a restart of the
+// controller. It is removed once the PV is updated.
+const PendingAttributesAnnotation = "dumbledore.k8s-storage.io/pending-attributes"
+
+// FailureAnnotation records on a claim why its attributes could not be
+// applied. It is removed once they are.
+const FailureAnnotation = "dumbledore.k8s-storage.io/failure"
+
+// applyFailure is recorded in FailureAnnotation.
+type applyFailure struct {
+	Rules   []string  `json:"rules"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// pendingAttributes is recorded in PendingAttributesAnnotation. Anyone
+// allowed to update the claim can write it, so it only names the pods and
+// the rules that matched them: the attributes are evaluated again from the
+// current rules when they are restored.
+type pendingAttributes struct {
+	Pods []pendingPod `json:"pods"`
+	// Conflicts are the attributes conflicting with other pods sharing the
+	// claim, with the rules involved. The value of the first rule is
+	// applied.
+	Conflicts map[string][]string `json:"conflicts,omitempty"`
+}
+
+// pendingPod is a pod whose attributes are pending.
+type pendingPod struct {
+	Name         string                 `json:"name,omitempty"`
+	GenerateName string                 `json:"generateName,omitempty"`
+	UID          types.UID              `json:"uid,omitempty"`
+	Labels       map[string]string      `json:"labels,omitempty"`
+	Owner        *metaV1.OwnerReference `json:"owner,omitempty"`
+	Rules        []string               `json:"rules"`
+}
+
+func newPendingPod(pod *coreV1.Pod, rules []string) pendingPod {
+	return pendingPod{
+		Name:         pod.Name,
+		GenerateName: pod.GenerateName,
+		UID:          pod.UID,
+		Labels:       pod.Labels,
+		Owner:        metaV1.GetControllerOf(pod),
+		Rules:        rules,
+	}
+}
+
+// pod returns the pod as far as it is recorded.
+func (p *pendingPod) pod(namespace string) *coreV1.Pod {
+	pod := &coreV1.Pod{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:         p.Name,
+			GenerateName: p.GenerateName,
+			Namespace:    namespace,
+			UID:          p.UID,
+			Labels:       p.Labels,
+		},
+	}
+	if p.Owner != nil {
+		pod.OwnerReferences = []metaV1.OwnerReference{*p.Owner}
+	}
+	return pod
+}
+
+// replaces tells whether the attributes of p replace those of a pod recorded
+// earlier: the same pod, or one with the same labels and rules, which yield
+// the same attributes.
+func (p *pendingPod) replaces(old *pendingPod) bool {
+	if len(p.Name) > 0 && p.Name == old.Name && p.UID == old.UID {
+		return true
+	}
+	return reflect.DeepEqual(p.Labels, old.Labels) && reflect.DeepEqual(p.Rules, old.Rules)
+}
+
+func encodePending(attrs *Attributes) (string, error) {
+	data, err := json.Marshal(pendingAttributes{
+		Pods:      attrs.pods,
+		Conflicts: attrs.conflicts,
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// decodePending restores the attributes recorded on a claim of the namespace
+// by evaluating the rules recorded for each pod again. Rules that are gone or
+// don't match the pod any more are dropped. It returns nil if no rule is
+// left.
+func (c *Controller) decodePending(namespace, data string) (*Attributes, error) {
+	pending := pendingAttributes{}
+	if err := json.Unmarshal([]byte(data), &pending); err != nil {
+		return nil, err
+	}
+	var attrs *Attributes
+	for i := range pending.Pods {
+		p := &pending.Pods[i]
+		a, err := c.evaluateRules(namespace, p.Labels, p.Rules)
+		if err != nil {
+			return nil, fmt.Errorf("pod %s: %v", podName(p.pod(namespace)), err)
+		}
+		if a == nil {
+			glog.V(3).Infof("rules %v of pod %s/%s don't match any more", p.Rules, namespace, podName(p.pod(namespace)))
+			continue
+		}
+		a.pod = p.pod(namespace)
+		a.pods = []pendingPod{*p}
+		// attributes of the pod that lost a conflict stay out.
+		for k, rules := range pending.Conflicts {
+			if _, ok := a.Values[k]; ok && len(rules) > 0 && a.Sources[k] != rules[0] {
+				a.remove(k)
+			}
+		}
+		if attrs == nil {
+			attrs = a
+		} else {
+			attrs = attrs.mergeIntent(a)
+		}
+	}
+	if attrs == nil {
+		return nil, nil
+	}
+	for k, rules := range pending.Conflicts {
+		if len(rules) > 0 {
+			attrs.conflicts[k] = rules
+		}
+	}
+	return attrs, nil
+}
+
+// loadPending restores the pending attributes recorded on a claim after a
+// restart, or by another replica. Attributes of pods admitted by this replica
+// that are not recorded yet take precedence.
+func (c *Controller) loadPending(pvc *coreV1.PersistentVolumeClaim) {
+	data, ok := pvc.Annotations[PendingAttributesAnnotation]
+	if !ok || c.isPendingLoaded(pvc.Namespace, pvc.Name, data) {
+		return
+	}
+	attrs, err := c.decodePending(pvc.Namespace, data)
+	if err != nil {
+		glog.Warningf("failed to parse pending attributes of pvc %s/%s: %v", pvc.Namespace, pvc.Name, err)
+		return
+	}
+	if attrs == nil {
+		glog.V(3).Infof("no pending rule of pvc %s/%s applies any more", pvc.Namespace, pvc.Name)
+		return
+	}
+	// templated values are rendered with the pod, it is only recorded by
+	// reference.
+	if name := attrs.pod.Name; len(name) > 0 {
+		pod, err := c.getPod(pvc.Namespace, name)
+		switch {
+		case err != nil:
+			glog.Warningf("failed to get pod %s/%s of the pending attributes of pvc %s: %v", pvc.Namespace, name, pvc.Name, err)
+		case len(attrs.pod.UID) == 0 || pod.UID == attrs.pod.UID:
+			attrs.pod = pod
+		}
+	}
+	attrs.pending = data
+	glog.V(3).Infof("restored pending rules %v of pvc %s/%s", attrs.Rules, pvc.Namespace, pvc.Name)
+	c.updatePodPVCMap(pvc.Namespace, pvc.Name, attrs, true /* toAdd */)
+}
+
+func (c *Controller) isPendingLoaded(pvcNS, pvcName, data string) bool {
+	c.podPVCLock.Lock()
+	defer c.podPVCLock.Unlock()
+	attrs := c.podPVCMap[pvcNS+"/"+pvcName]
+	return attrs != nil && (attrs.pending == data || len(attrs.pending) == 0)
+}
+
+func (c *Controller) setPending(attrs *Attributes, data string) {
+	c.podPVCLock.Lock()
+	defer c.podPVCLock.Unlock()
+	attrs.pending = data
+}
+
+// handOver stops queueing pods and records the attributes still pending on
+// their claims, for the next leader to pick them up.
+func (c *Controller) handOver() {
+	c.podPVCLock.Lock()
+	c.running = false
+	pending := make(map[string]*Attributes, len(c.podPVCMap))
+	for key, attrs := range c.podPVCMap {
+		pending[key] = attrs
+	}
+	c.podPVCLock.Unlock()
+
+	for key, attrs := range pending {
+		parts := strings.SplitN(key, "/", 2)
+		if err := c.persistPendingClaim(parts[0], parts[1], attrs); err != nil {
+			glog.Warningf("failed to hand over: %v", err)
+		}
+	}
+	glog.Infof("handed over the pending attributes of %d claims", len(pending))
+}
+
+// persistPendingClaim records the attributes on a claim read from the API
+// server.
+func (c *Controller) persistPendingClaim(namespace, name string, attrs *Attributes) error {
+	pvc, err := c.clientset.CoreV1().PersistentVolumeClaims(namespace).Get(name, metaV1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		if attrs.pod != nil {
+			c.recordPodEvent(attrs.pod, coreV1.EventTypeWarning, EventClaimNotFound, "Claim %s not found, rules %v not applied", name, attrs.Rules)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get pvc %s/%s: %v", namespace, name, err)
+	}
+	return c.persistPending(pvc, attrs)
+}
+
+// persistPending records the attributes on the claim until it is bound.
+func (c *Controller) persistPending(pvc *coreV1.PersistentVolumeClaim, attrs *Attributes) error {
+	data, err := encodePending(attrs)
+	if err != nil {
+		return err
+	}
+	changed, err := c.updateClaimAnnotations(pvc, map[string]string{PendingAttributesAnnotation: data})
+	if err != nil {
+		return fmt.Errorf("failed to record pending attributes on pvc %s/%s: %v", pvc.Namespace, pvc.Name, err)
+	}
+	c.setPending(attrs, data)
+	if changed && pvc.Status.Phase != coreV1.ClaimBound {
+		c.recorder.Eventf(pvc, coreV1.EventTypeNormal, EventDeferred, "Rules %v are applied once the claim is bound", attrs.Rules)
+	}
+	return nil
+}
+
+// clearPending removes the attributes and any failure from the claim once
+// they are applied.
+func (c *Controller) clearPending(pvc *coreV1.PersistentVolumeClaim) error {
+	if _, err := c.updateClaimAnnotations(pvc, nil, PendingAttributesAnnotation, FailureAnnotation); err != nil {
+		return fmt.Errorf("failed to remove pending attributes from pvc %s/%s: %v", pvc.Namespace, pvc.Name, err)
+	}
+	return nil
+}
+
+// recordFailure records on the claim why the attributes were not applied,
+// for the admission of pods of fail-closed rules. If the failure is
+// permanent, the pending attributes are removed as well. A failure that is
+// recorded already is not recorded again, the update of the claim would
+// queue it again right away.
+func (c *Controller) recordFailure(pvc *coreV1.PersistentVolumeClaim, attrs *Attributes, failure error, permanent bool) error {
+	if old, ok := parseFailure(pvc); ok && old.Message == failure.Error() && reflect.DeepEqual(old.Rules, attrs.Rules) {
+		if !permanent {
+			return nil
+		}
+		_, err := c.updateClaimAnnotations(pvc, nil, PendingAttributesAnnotation)
+		return err
+	}
+	data, err := json.Marshal(applyFailure{
+		Rules:   attrs.Rules,
+		Message: failure.Error(),
+		Time:    time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	var remove []string
+	if permanent {
+		remove = append(remove, PendingAttributesAnnotation)
+	}
+	if _, err := c.updateClaimAnnotations(pvc, map[string]string{FailureAnnotation: string(data)}, remove...); err != nil {
+		return fmt.Errorf("failed to record failure on pvc %s/%s: %v", pvc.Namespace, pvc.Name, err)
+	}
+	return nil
+}
+
+func parseFailure(pvc *coreV1.PersistentVolumeClaim) (*applyFailure, bool) {
+	data, ok := pvc.Annotations[FailureAnnotation]
+	if !ok {
+		return nil, false
+	}
+	failure := &applyFailure{}
+	if err := json.Unmarshal([]byte(data), failure); err != nil {
+		glog.Warningf("failed to parse failure of pvc %s/%s: %v", pvc.Namespace, pvc.Name, err)
+		return nil, false
+	}
+	return failure, true
+}
+
+// updateClaimAnnotations sets and removes annotations of the claim. It
+// returns false if they were already up to date.
+func (c *Controller) updateClaimAnnotations(pvc *coreV1.PersistentVolumeClaim, set map[string]string, remove ...string) (bool, error) {
+	changed := false
+	for k, v := range set {
+		if old, ok := pvc.Annotations[k]; !ok || old != v {
+			changed = true
+		}
+	}
+	for _, k := range remove {
+		if _, ok := pvc.Annotations[k]; ok {
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+	pvc = pvc.DeepCopy()
+	if pvc.Annotations == nil {
+		pvc.Annotations = map[string]string{}
+	}
+	for k, v := range set {
+		pvc.Annotations[k] = v
+	}
+	for _, k := range remove {
+		delete(pvc.Annotations, k)
+	}
+	if _, err := c.clientset.CoreV1().PersistentVolumeClaims(pvc.Namespace).Update(pvc); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,90 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// newTestClientset returns a clientset of an API server serving the objects
+// by path, other requests fail with NotFound.
+func newTestClientset(t *testing.T, objects map[string]interface{}) *kubernetes.Clientset {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		obj, ok := objects[r.URL.Path]
+		if !ok || r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(metaV1.Status{
+				TypeMeta: metaV1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+				Status:   metaV1.StatusFailure,
+				Reason:   metaV1.StatusReasonNotFound,
+				Code:     http.StatusNotFound,
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(obj)
+	}))
+	t.Cleanup(server.Close)
+	return kubernetes.NewForConfigOrDie(&rest.Config{Host: server.URL})
+}
+
+func TestLoadPendingWithoutPodStore(t *testing.T) {
+	pod := &coreV1.Pod{
+		TypeMeta: metaV1.TypeMeta{Kind: "Pod", APIVersion: "v1"},
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:      "db-0",
+			Namespace: "team-a",
+			UID:       "uid-1",
+			Labels:    map[string]string{"app": "database"},
+		},
+		Spec: coreV1.PodSpec{Containers: []coreV1.Container{{Name: "db"}}},
+	}
+	ns := &coreV1.Namespace{
+		TypeMeta:   metaV1.TypeMeta{Kind: "Namespace", APIVersion: "v1"},
+		ObjectMeta: metaV1.ObjectMeta{Name: "team-a"},
+	}
+	// webhook mode has no pod informer.
+	c := NewPVController(newTestClientset(t, map[string]interface{}{
+		"/api/v1/namespaces/team-a/pods/db-0": pod,
+		"/api/v1/namespaces/team-a":           ns,
+	}))
+	conf, err := ConfigMapToConfig(&coreV1.ConfigMap{Data: map[string]string{"config": `
+- name: database
+  label: database
+  attributes: '{"container": "{{ .Pod.Spec.Containers[0].Name }}"}'
+`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetConfig(conf)
+
+	pending, err := encodePending(&Attributes{pods: []pendingPod{newPendingPod(pod, []string{"database"})}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pvc := &coreV1.PersistentVolumeClaim{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:        "data-db-0",
+			Namespace:   "team-a",
+			Annotations: map[string]string{PendingAttributesAnnotation: pending},
+		},
+	}
+	c.loadPending(pvc)
+
+	attrs := c.getPodPVCMap("team-a", "data-db-0")
+	if attrs == nil {
+		t.Fatalf("pending attributes of pvc team-a/data-db-0 not loaded")
+	}
+	if got := attrs.Values["container"]; got != "{{ .Pod.Spec.Containers[0].Name }}" {
+		t.Errorf("attribute container = %v, want the template", got)
+	}
+	if len(attrs.pod.Spec.Containers) != 1 {
+		t.Errorf("pod of the pending attributes = %+v, want the pod read from the API server", attrs.pod)
+	}
+}
@@ -0,0 +1,284 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+
+	"github.com/ghodss/yaml"
+	"github.com/golang/glog"
+
+	"github.com/k8s-storage/dumbledore/pkg/metrics"
+
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// DriverProfilesConfigMap is the ConfigMap in IntializerNamespace holding the
+// driver profiles, empty to not validate attributes.
+var DriverProfilesConfigMap string
+
+// DriverProfile declares the attributes a CSI driver accepts.
+type DriverProfile struct {
+	// Driver is the name of the CSI driver.
+	Driver string `json:"driver"`
+	// Attributes are the schemas of the accepted attributes.
+	Attributes map[string]AttributeSchema `json:"attributes"`
+	// AllowUnknown accepts attributes that are not declared.
+	AllowUnknown bool `json:"allowUnknown,omitempty"`
+}
+
+// AttributeSchema declares the values an attribute accepts.
+type AttributeSchema struct {
+	// Type is string, integer, number, boolean, object or array, any type if
+	// empty.
+	Type string `json:"type,omitempty"`
+	// Enum lists the accepted values.
+	Enum []interface{} `json:"enum,omitempty"`
+	// Pattern is a regular expression strings must match.
+	Pattern string `json:"pattern,omitempty"`
+	// Minimum and Maximum bound numbers.
+	Minimum *float64 `json:"minimum,omitempty"`
+	Maximum *float64 `json:"maximum,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// ConfigMapToProfiles parses the driver profiles in the "profiles" key of the
+// ConfigMap.
+func ConfigMapToProfiles(cm *coreV1.ConfigMap) (map[string]*DriverProfile, error) {
+	data, err := yaml.YAMLToJSON([]byte(cm.Data["profiles"]))
+	if err != nil {
+		return nil, err
+	}
+	var list []*DriverProfile
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&list); err != nil {
+		return nil, err
+	}
+	profiles := map[string]*DriverProfile{}
+	for _, p := range list {
+		if len(p.Driver) == 0 {
+			return nil, fmt.Errorf("driver profile without driver")
+		}
+		if _, ok := profiles[p.Driver]; ok {
+			return nil, fmt.Errorf("driver %s has two profiles", p.Driver)
+		}
+		for k, schema := range p.Attributes {
+			switch schema.Type {
+			case "", "string", "integer", "number", "boolean", "object", "array":
+			default:
+				return nil, fmt.Errorf("driver %s: attribute %s has unknown type %q", p.Driver, k, schema.Type)
+			}
+			if len(schema.Pattern) > 0 {
+				if schema.pattern, err = regexp.Compile(schema.Pattern); err != nil {
+					return nil, fmt.Errorf("driver %s: attribute %s has an invalid pattern: %v", p.Driver, k, err)
+				}
+			}
+			p.Attributes[k] = schema
+		}
+		profiles[p.Driver] = p
+	}
+	return profiles, nil
+}
+
+// validate checks the values against the profile. Null values remove an
+// attribute, only their name is checked. Values that are only known once
+// they are applied, templates, generated keys and secret attributes, are
+// expected to be strings.
+func (p *DriverProfile) validate(attrs *Attributes, values map[string]interface{}) error {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		schema, ok := p.Attributes[k]
+		if !ok {
+			if p.AllowUnknown {
+				continue
+			}
+			return fmt.Errorf("driver %s doesn't accept attribute %s", p.Driver, k)
+		}
+		v := values[k]
+		if v == nil {
+			continue
+		}
+		if !isPlainValue(v) {
+			if len(schema.Type) > 0 && schema.Type != "string" {
+				return fmt.Errorf("attribute %s of driver %s must be of type %s", k, p.Driver, schema.Type)
+			}
+			continue
+		}
+		if err := schema.validate(v); err != nil {
+			return fmt.Errorf("attribute %s=%v of driver %s: %v", k, attrs.redactValue(k, v), p.Driver, err)
+		}
+	}
+	return nil
+}
+
+func (s *AttributeSchema) validate(v interface{}) error {
+	switch s.Type {
+	case "string":
+		if _, ok := v.(string); !ok {
+			return fmt.Errorf("must be a string")
+		}
+	case "integer":
+		if f, ok := v.(float64); !ok || f != math.Trunc(f) {
+			return fmt.Errorf("must be an integer")
+		}
+	case "number":
+		if _, ok := v.(float64); !ok {
+			return fmt.Errorf("must be a number")
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("must be a boolean")
+		}
+	case "object":
+		if _, ok := v.(map[string]interface{}); !ok {
+			return fmt.Errorf("must be an object")
+		}
+	case "array":
+		if _, ok := v.([]interface{}); !ok {
+			return fmt.Errorf("must be an array")
+		}
+	}
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			found = found || reflect.DeepEqual(e, v)
+		}
+		if !found {
+			return fmt.Errorf("must be one of %v", s.Enum)
+		}
+	}
+	if str, ok := v.(string); ok && s.pattern != nil && !s.pattern.MatchString(str) {
+		return fmt.Errorf("must match %s", s.Pattern)
+	}
+	if f, ok := v.(float64); ok {
+		if s.Minimum != nil && f < *s.Minimum {
+			return fmt.Errorf("must be at least %v", *s.Minimum)
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			return fmt.Errorf("must be at most %v", *s.Maximum)
+		}
+	}
+	return nil
+}
+
+// SetProfiles replaces the driver profiles, nil to not validate attributes.
+func (c *Controller) SetProfiles(profiles map[string]*DriverProfile) {
+	c.configLock.Lock()
+	c.profiles = profiles
+	c.configLock.Unlock()
+	// the rules stay in effect, their values are checked again before a PV
+	// is updated.
+	if err := c.ValidateRules(c.getConfig()); err != nil {
+		glog.Warningf("rules don't match the driver profiles: %v", err)
+	}
+}
+
+func (c *Controller) getProfile(driver string) *DriverProfile {
+	c.configLock.RLock()
+	defer c.configLock.RUnlock()
+	return c.profiles[driver]
+}
+
+// ValidateRules checks the attributes of the rules scoped to drivers against
+// the profiles of the drivers. Rules that are not scoped to drivers are only
+// checked before a PV is updated.
+func (c *Controller) ValidateRules(config []Config) error {
+	for i := range config {
+		conf := &config[i]
+		for _, driver := range conf.Drivers {
+			p := c.getProfile(driver)
+			if p == nil {
+				continue
+			}
+			attrs := &Attributes{sensitive: map[string]bool{}}
+			values := conf.values()
+			for k := range values {
+				attrs.sensitive[k] = conf.isSensitive(k)
+			}
+			if err := p.validate(attrs, values); err != nil {
+				return fmt.Errorf("rule %s: %v", conf.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// validateValues checks the values about to be applied to the PV against the
+// profile of its driver. Secret attributes are not resolved yet, only their
+// type is checked.
+func (c *Controller) validateValues(pv *coreV1.PersistentVolume, attrs *Attributes, values map[string]interface{}) error {
+	if pv.Spec.CSI == nil {
+		return nil
+	}
+	p := c.getProfile(pv.Spec.CSI.Driver)
+	if p == nil {
+		return nil
+	}
+	return p.validate(attrs, values)
+}
+
+// validatePatched checks the attributes changed by the JSON patches of the
+// rules against the profile of the PV's driver.
+func (c *Controller) validatePatched(pv *coreV1.PersistentVolume, attrs *Attributes, patched map[string]interface{}) error {
+	if len(attrs.patches) == 0 {
+		return nil
+	}
+	values := map[string]interface{}{}
+	for _, p := range attrs.patches {
+		for _, k := range patchKeys(p.Ops) {
+			values[k] = patched[k]
+		}
+	}
+	return c.validateValues(pv, attrs, values)
+}
+
+// NewProfileWatcher watches the DriverProfilesConfigMap ConfigMap.
+func NewProfileWatcher(clientset *kubernetes.Clientset, ctrl *Controller) *ConfigWatcher {
+	w := &ConfigWatcher{ctrl: ctrl}
+
+	load := func(obj interface{}) {
+		cm := obj.(*coreV1.ConfigMap)
+		profiles, err := ConfigMapToProfiles(cm)
+		if err != nil {
+			glog.Errorf("failed to parse driver profiles %s/%s, keeping the last good profiles: %v", cm.Namespace, cm.Name, err)
+			metrics.ConfigReloads.WithLabelValues("failure").Inc()
+			return
+		}
+		w.ctrl.SetProfiles(profiles)
+		metrics.ConfigReloads.WithLabelValues("success").Inc()
+	}
+	_, informer := cache.NewInformer(
+		cache.NewListWatchFromClient(
+			clientset.CoreV1().RESTClient(),
+			"configmaps",
+			IntializerNamespace,
+			fields.OneTermEqualSelector("metadata.name", DriverProfilesConfigMap)),
+		&coreV1.ConfigMap{},
+		resyncPeriod,
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: load,
+			UpdateFunc: func(old, new interface{}) {
+				load(new)
+			},
+			DeleteFunc: func(obj interface{}) {
+				glog.Warningf("driver profiles %s/%s deleted, attributes are not validated any more", IntializerNamespace, DriverProfilesConfigMap)
+				w.ctrl.SetProfiles(nil)
+			},
+		},
+	)
+	w.informers = append(w.informers, informer)
+	return w
+}
@@ -0,0 +1,26 @@
+package controller
+
+import (
+	"time"
+
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	// baseRetryDelay is the delay before the first retry of a failed item,
+	// it doubles with every failure up to maxRetryDelay.
+	baseRetryDelay = 100 * time.Millisecond
+	maxRetryDelay  = 5 * time.Minute
+	// maxRetries is how often a failed item is retried before it is dropped
+	// from the queue. Items still pending are queued again by the informer
+	// resync.
+	maxRetries = 15
+
+	queueName = "dumbledore"
+)
+
+// newQueue returns the rate limited work queue of the controller. An item is
+// in the queue at most once and handed to one worker at a time.
+func newQueue() workqueue.RateLimitingInterface {
+	return workqueue.NewNamedRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(baseRetryDelay, maxRetryDelay), queueName)
+}
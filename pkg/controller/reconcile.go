@@ -0,0 +1,198 @@
+package controller
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+
+	coreV1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// workers is the number of items processed in parallel.
+	workers = 4
+
+	podKind = "pod"
+	pvcKind = "pvc"
+	pvKind  = "pv"
+)
+
+// queueKey identifies the object a queued item is about. PV events queue the
+// claim of the PV, the attributes to apply are tracked per claim.
+type queueKey struct {
+	kind      string
+	namespace string
+	name      string
+}
+
+func (k queueKey) String() string {
+	return k.kind + " " + k.namespace + "/" + k.name
+}
+
+// enqueuePod queues pods waiting for the initializer.
+func (c *Controller) enqueuePod(pod *coreV1.Pod) {
+	if isPendingInitializer(pod) {
+		c.queue.Add(queueKey{kind: podKind, namespace: pod.Namespace, name: pod.Name})
+	}
+}
+
+// enqueuePVC queues claims with attributes still to apply, including those
+// recorded on the claim before a restart.
+func (c *Controller) enqueuePVC(pvc *coreV1.PersistentVolumeClaim) {
+	c.loadPending(pvc)
+	if c.getPodPVCMap(pvc.Namespace, pvc.Name) != nil {
+		c.queue.Add(queueKey{kind: pvcKind, namespace: pvc.Namespace, name: pvc.Name})
+	}
+}
+
+// enqueuePV queues the claim of the PV if it has attributes still to apply,
+// and the PV if it has attributes of rules that were deleted or changed.
+func (c *Controller) enqueuePV(pv *coreV1.PersistentVolume) {
+	ref := pv.Spec.ClaimRef
+	if ref != nil && c.getPodPVCMap(ref.Namespace, ref.Name) != nil {
+		c.queue.Add(queueKey{kind: pvcKind, namespace: ref.Namespace, name: ref.Name})
+	}
+	if len(c.staleKeys(parseOwned(pv))) > 0 {
+		c.queue.Add(queueKey{kind: pvKind, name: pv.Name})
+	}
+}
+
+func (c *Controller) runWorker() {
+	for c.processNextItem() {
+	}
+}
+
+func (c *Controller) processNextItem() bool {
+	item, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(item)
+
+	key := item.(queueKey)
+	err := c.sync(key)
+	switch {
+	case err == nil:
+		c.queue.Forget(item)
+	case c.queue.NumRequeues(item) < maxRetries:
+		glog.Warningf("failed to sync %s, retrying: %v", key, err)
+		c.queue.AddRateLimited(item)
+	default:
+		glog.Errorf("failed to sync %s %d times, giving up until the next resync: %v", key, maxRetries, err)
+		c.queue.Forget(item)
+	}
+	return true
+}
+
+func (c *Controller) sync(key queueKey) error {
+	switch key.kind {
+	case podKind:
+		return c.syncPod(key.namespace, key.name)
+	case pvcKind:
+		return c.syncPVC(key.namespace, key.name)
+	case pvKind:
+		return c.syncPV(key.name)
+	}
+	return fmt.Errorf("unknown kind %s", key.kind)
+}
+
+func (c *Controller) syncPod(namespace, name string) error {
+	obj, exists, err := c.podStore.GetByKey(namespace + "/" + name)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		c.deleteInitializing(namespace + "/" + name)
+		return nil
+	}
+	return c.addPod(obj.(*coreV1.Pod))
+}
+
+// syncPVC applies the pending attributes of a claim once it is bound. Until
+// then they are recorded on the claim, they stay pending until the PV was
+// updated.
+func (c *Controller) syncPVC(namespace, name string) error {
+	attrs := c.getPodPVCMap(namespace, name)
+	if attrs == nil {
+		return nil
+	}
+	pvc, err := c.getPVC(namespace, name)
+	if apierrors.IsNotFound(err) {
+		glog.V(3).Infof("pvc %s/%s is gone", namespace, name)
+		if attrs.pod != nil {
+			c.recordPodEvent(attrs.pod, coreV1.EventTypeWarning, EventClaimNotFound, "Claim %s not found, rules %v not applied", name, attrs.Rules)
+		}
+		c.updatePodPVCMap(namespace, name, nil, false /* toAdd */)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if pvc.Status.Phase != coreV1.ClaimBound || len(pvc.Spec.VolumeName) == 0 {
+		volume := c.prebindVolume(pvc, attrs)
+		if len(volume) == 0 {
+			// defer till PVC is bound
+			return c.persistPending(pvc, attrs)
+		}
+		// spec.csi.volumeAttributes can only be written before the PV is
+		// bound.
+		glog.V(3).Infof("applying rules %v to pv %s before pvc %s/%s is bound", attrs.Rules, volume, namespace, name)
+		pvc = pvc.DeepCopy()
+		pvc.Spec.VolumeName = volume
+	}
+	switch err := c.updatePVAnnotation(pvc, attrs).(type) {
+	case nil:
+		if err := c.clearPending(pvc); err != nil {
+			return err
+		}
+	case *permanentError:
+		// retrying can't fix it, give up on the attributes.
+		glog.Warningf("giving up on rules %v for pvc %s/%s: %v", attrs.Rules, namespace, name, err)
+		if err := c.recordFailure(pvc, attrs, err, true /* permanent */); err != nil {
+			return err
+		}
+	case *conflictError:
+		return err
+	default:
+		if err := c.recordFailure(pvc, attrs, err, false /* permanent */); err != nil {
+			glog.Warningf("%v", err)
+		}
+		return err
+	}
+	c.clearPodPVCMap(namespace, name, attrs)
+	return nil
+}
+
+// getPVC reads the claim from the cache, or from the API server if it is
+// too new to be cached.
+func (c *Controller) getPVC(namespace, name string) (*coreV1.PersistentVolumeClaim, error) {
+	obj, exists, err := c.pvcStore.GetByKey(namespace + "/" + name)
+	if err == nil && exists {
+		return obj.(*coreV1.PersistentVolumeClaim), nil
+	}
+	return c.clientset.CoreV1().PersistentVolumeClaims(namespace).Get(name, metaV1.GetOptions{})
+}
+
+// getPV reads the PV from the cache, or from the API server if it is too new
+// to be cached.
+func (c *Controller) getPV(name string) (*coreV1.PersistentVolume, error) {
+	obj, exists, err := c.pvStore.GetByKey(name)
+	if err == nil && exists {
+		return obj.(*coreV1.PersistentVolume), nil
+	}
+	return c.clientset.CoreV1().PersistentVolumes().Get(name, metaV1.GetOptions{})
+}
+
+// getPod reads the pod from the cache, or from the API server if it is too
+// new to be cached. Pods are only cached by the initializer.
+func (c *Controller) getPod(namespace, name string) (*coreV1.Pod, error) {
+	if c.podStore != nil {
+		obj, exists, err := c.podStore.GetByKey(namespace + "/" + name)
+		if err == nil && exists {
+			return obj.(*coreV1.Pod), nil
+		}
+	}
+	return c.clientset.CoreV1().Pods(namespace).Get(name, metaV1.GetOptions{})
+}
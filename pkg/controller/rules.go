@@ -0,0 +1,309 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+type MergeStrategy string
+
+const (
+	// MergeOverride replaces values set by rules merged earlier and values
+	// already on the PV. It is the default.
+	MergeOverride MergeStrategy = "override"
+	// MergeKeepExisting keeps values set by rules merged earlier and values
+	// already on the PV.
+	MergeKeepExisting MergeStrategy = "keep-existing"
+	// MergeFailOnConflict fails if a value set by a rule merged earlier or
+	// already on the PV differs.
+	MergeFailOnConflict MergeStrategy = "fail-on-conflict"
+)
+
+// Attributes are the effective attributes of all rules matching a pod.
+type Attributes struct {
+	// Rules are the names of the matching rules in merge order.
+	Rules []string
+	// Values are the merged attributes.
+	Values map[string]interface{}
+	// Sources are the names of the rules that set the values.
+	Sources map[string]string
+	// strategies are the merge strategies of the rules that set the values.
+	strategies map[string]MergeStrategy
+	// targets are where the rules that set the values write them.
+	targets map[string]Target
+	// sensitive are the values to redact.
+	sensitive map[string]bool
+	// strict are the names of the matching rules with strict enforcement.
+	strict map[string]bool
+	// failClosed are the names of the matching rules whose pods are not
+	// admitted if their attributes can't be applied.
+	failClosed map[string]bool
+	// conflicts are the attributes that conflict with those of other pods
+	// sharing the claim, with the rules involved.
+	conflicts map[string][]string
+	// patches are the JSON Patch operations of the rules in merge order.
+	patches []rulePatch
+	// pod is the pod the attributes were evaluated for, templated values are
+	// rendered with it.
+	pod *coreV1.Pod
+	// pods are the pods whose attributes were merged, in admission order.
+	pods []pendingPod
+	// pending is the PendingAttributesAnnotation the attributes were
+	// recorded as or restored from, guarded by the controller's podPVCLock.
+	pending string
+}
+
+// EffectiveAttribute is an attribute as recorded in EffectiveAttributesAnnotation.
+type EffectiveAttribute struct {
+	Value interface{} `json:"value"`
+	Rule  string      `json:"rule"`
+}
+
+// getAttributes evaluates all rules matching a pod and merges them, or
+// returns nil if none matches. Rules are merged in order of priority, with
+// namespaced rules of the pod's namespace before cluster rules, so that a
+// tenant rule can add attributes but not override those of a cluster rule.
+// Rules with the same priority are merged in order of their names. If the
+// rules conflict, the attributes merged so far are returned with the error.
+func (c *Controller) getAttributes(namespace string, podLabels map[string]string) (*Attributes, error) {
+	return c.evaluateRules(namespace, podLabels, nil)
+}
+
+// evaluateRules is getAttributes for the rules named in only, or all rules
+// if only is nil.
+func (c *Controller) evaluateRules(namespace string, podLabels map[string]string, only []string) (*Attributes, error) {
+	if isExcludedNamespace(namespace) {
+		glog.V(5).Infof("namespace %s is excluded", namespace)
+		return nil, nil
+	}
+	nsLabels, nsErr := c.getNamespaceLabels(namespace)
+
+	var matched []*Config
+	// unevaluated are the fail-closed rules matching the pod whose namespace
+	// selector can't be evaluated.
+	var unevaluated []string
+	config := c.getConfig()
+	for i := range config {
+		conf := &config[i]
+		if conf.claimOnly() || (only != nil && !contains(only, conf.Name)) {
+			continue
+		}
+		if !conf.selector.Matches(labels.Set(podLabels)) {
+			continue
+		}
+		switch {
+		case len(conf.Namespace) > 0:
+			if conf.Namespace != namespace {
+				continue
+			}
+		case nsErr != nil && conf.NamespaceSelector != nil:
+			glog.Warningf("skipping rule %s for namespace %s: %v", conf.Name, namespace, nsErr)
+			if conf.failurePolicy() == FailClosed {
+				unevaluated = append(unevaluated, conf.Name)
+			}
+			continue
+		case !conf.namespaceSelector.Matches(labels.Set(nsLabels)):
+			continue
+		}
+		matched = append(matched, conf)
+	}
+	if len(matched)+len(unevaluated) == 0 {
+		return nil, nil
+	}
+	sortRules(matched)
+
+	attrs := &Attributes{
+		Values:     map[string]interface{}{},
+		Sources:    map[string]string{},
+		strategies: map[string]MergeStrategy{},
+		targets:    map[string]Target{},
+		sensitive:  map[string]bool{},
+		strict:     map[string]bool{},
+		failClosed: map[string]bool{},
+		conflicts:  map[string][]string{},
+	}
+	if len(unevaluated) > 0 {
+		// the pod is rejected, the other rules are not merged.
+		attrs.Rules = unevaluated
+		for _, rule := range unevaluated {
+			attrs.failClosed[rule] = true
+		}
+		return attrs, &unevaluatedError{fmt.Errorf("rules %v can't be evaluated: %v", unevaluated, nsErr)}
+	}
+	for _, conf := range matched {
+		if conf.failurePolicy() == FailClosed {
+			attrs.failClosed[conf.Name] = true
+		}
+	}
+	for _, conf := range matched {
+		for k, v := range conf.values() {
+			if existing, ok := attrs.Values[k]; ok {
+				// the values of both rules are merge patches, they are
+				// combined into one.
+				merged := mergePatch(existing, v, true)
+				switch conf.mergeStrategy() {
+				case MergeKeepExisting:
+					glog.V(5).Infof("rule %s keeps %s of rule %s", conf.Name, k, attrs.Sources[k])
+					continue
+				case MergeFailOnConflict:
+					if !reflect.DeepEqual(existing, merged) {
+						return attrs, fmt.Errorf("rule %s conflicts with rule %s on %s", conf.Name, attrs.Sources[k], k)
+					}
+				default:
+					glog.V(5).Infof("rule %s overrides %s of rule %s", conf.Name, k, attrs.Sources[k])
+				}
+				v = merged
+			}
+			attrs.Values[k] = v
+			attrs.Sources[k] = conf.Name
+			attrs.strategies[k] = conf.mergeStrategy()
+			attrs.targets[k] = conf.target()
+			attrs.sensitive[k] = conf.isSensitive(k)
+		}
+		attrs.Rules = append(attrs.Rules, conf.Name)
+		if len(conf.JSONPatch) > 0 {
+			attrs.patches = append(attrs.patches, rulePatch{Rule: conf.Name, Ops: conf.JSONPatch})
+		}
+		if conf.enforcement() == EnforcementStrict {
+			attrs.strict[conf.Name] = true
+		}
+	}
+	return attrs, nil
+}
+
+// merge merges the values into the attributes already on a PV as a JSON
+// Merge Patch, honoring the merge strategy of the rule each value came from
+// for the attributes not owned by dumbledore. Objects are merged recursively
+// and null removes an attribute. It returns the attributes it set with the
+// rules they came from.
+func (a *Attributes) merge(values, existing map[string]interface{}, owned map[string]string) (map[string]EffectiveAttribute, error) {
+	effective := map[string]EffectiveAttribute{}
+	for k, v := range values {
+		old, ok := existing[k]
+		merged := mergePatch(old, v, false)
+		if ok && len(owned[k]) == 0 {
+			switch a.strategies[k] {
+			case MergeKeepExisting:
+				continue
+			case MergeFailOnConflict:
+				if v == nil || !reflect.DeepEqual(old, merged) {
+					return nil, fmt.Errorf("rule %s conflicts with %s=%v on the PV", a.Sources[k], k, a.redactValue(k, old))
+				}
+			}
+		}
+		if v == nil {
+			glog.V(5).Infof("remove %v", k)
+			delete(existing, k)
+			continue
+		}
+		glog.V(5).Infof("add %v %v", k, a.redactValue(k, merged))
+		existing[k] = merged
+		effective[k] = EffectiveAttribute{Value: v, Rule: a.Sources[k]}
+	}
+	return effective, nil
+}
+
+// describeChanges lists the attributes that differ between before and after,
+// with the sensitive values redacted.
+func (a *Attributes) describeChanges(before, after map[string]interface{}) string {
+	var changes, removed []string
+	for k, v := range after {
+		if old, ok := before[k]; ok && reflect.DeepEqual(old, v) {
+			continue
+		}
+		changes = append(changes, fmt.Sprintf("%s=%v", k, a.redactValue(k, v)))
+	}
+	for k := range before {
+		if _, ok := after[k]; !ok {
+			removed = append(removed, k)
+		}
+	}
+	if len(changes)+len(removed) == 0 {
+		return "no attributes changed"
+	}
+	sort.Strings(changes)
+	sort.Strings(removed)
+	var parts []string
+	if len(changes) > 0 {
+		parts = append(parts, "set "+strings.Join(changes, ", "))
+	}
+	if len(removed) > 0 {
+		parts = append(parts, "removed "+strings.Join(removed, ", "))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// values returns the attributes of the rule, including the generated keys
+// and secret attributes.
+func (conf *Config) values() map[string]interface{} {
+	values := map[string]interface{}{}
+	// the attributes are validated when the rules are loaded.
+	json.Unmarshal([]byte(conf.Attributes), &values)
+	for _, key := range conf.GeneratedKeys {
+		length := key.Length
+		if length == 0 {
+			length = defaultKeyLength
+		}
+		values[key.Attribute] = generatedKey{length: length}
+	}
+	for _, attr := range conf.SecretAttributes {
+		values[attr.Attribute] = secretValue{ref: attr.SecretKeyRef}
+	}
+	return values
+}
+
+func (conf *Config) mergeStrategy() MergeStrategy {
+	if len(conf.MergeStrategy) == 0 {
+		return MergeOverride
+	}
+	return conf.MergeStrategy
+}
+
+// sortRules orders the matched rules in the order they are merged, later
+// rules win: namespaced rules before cluster rules, then by priority and name.
+func sortRules(matched []*Config) {
+	sort.Slice(matched, func(i, j int) bool {
+		a, b := matched[i], matched[j]
+		if (len(a.Namespace) > 0) != (len(b.Namespace) > 0) {
+			return len(a.Namespace) > 0
+		}
+		if a.Priority != b.Priority {
+			return a.Priority < b.Priority
+		}
+		return a.Name < b.Name
+	})
+}
+
+func (c *Controller) getNamespaceLabels(namespace string) (map[string]string, error) {
+	ns, err := c.getNamespace(namespace)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get namespace %s: %v", namespace, err)
+	}
+	return ns.Labels, nil
+}
+
+func (c *Controller) getNamespace(namespace string) (*coreV1.Namespace, error) {
+	obj, exists, err := c.nsStore.GetByKey(namespace)
+	if err == nil && exists {
+		return obj.(*coreV1.Namespace), nil
+	}
+	return c.clientset.CoreV1().Namespaces().Get(namespace, metaV1.GetOptions{})
+}
+
+func isExcludedNamespace(namespace string) bool {
+	for _, ns := range strings.Split(ExcludedNamespaces, ",") {
+		if strings.TrimSpace(ns) == namespace {
+			return true
+		}
+	}
+	return false
+}
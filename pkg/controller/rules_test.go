@@ -0,0 +1,54 @@
+package controller
+
+import (
+	"testing"
+
+	coreV1 "k8s.io/api/core/v1"
+)
+
+func TestEvaluateRulesWithoutNamespace(t *testing.T) {
+	// the namespace can't be read.
+	c := NewPVController(newTestClientset(t, nil))
+	conf, err := ConfigMapToConfig(&coreV1.ConfigMap{Data: map[string]string{"config": `
+- name: encryption
+  label: database
+  namespaceSelector:
+    matchLabels:
+      tenant: acme
+  failurePolicy: fail-closed
+  attributes: '{"dmcrypt": "enabled"}'
+- name: replication
+  label: database
+  namespaceSelector:
+    matchLabels:
+      tenant: acme
+  attributes: '{"replicas": 3}'
+- name: tier
+  label: database
+  attributes: '{"tier": "gold"}'
+`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.SetConfig(conf[1:])
+	attrs, err := c.evaluateRules("team-a", map[string]string{"app": "database"}, nil)
+	if err != nil {
+		t.Fatalf("fail-open rules: %v", err)
+	}
+	if len(attrs.Rules) != 1 || attrs.Rules[0] != "tier" {
+		t.Errorf("fail-open rules = %v, want [tier]", attrs.Rules)
+	}
+
+	c.SetConfig(conf)
+	attrs, err = c.evaluateRules("team-a", map[string]string{"app": "database"}, nil)
+	if _, ok := err.(*unevaluatedError); !ok {
+		t.Fatalf("fail-closed rules: got error %v, want the rules unevaluated", err)
+	}
+	if !attrs.failsClosed() {
+		t.Errorf("fail-closed rules %v don't fail closed", attrs.Rules)
+	}
+	if attrs, err = c.evaluateRules("team-a", map[string]string{"app": "web"}, nil); attrs != nil || err != nil {
+		t.Errorf("rules not matching the pod = %v, %v, want none", attrs, err)
+	}
+}
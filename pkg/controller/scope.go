@@ -0,0 +1,108 @@
+package controller
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+
+	"github.com/k8s-storage/dumbledore/pkg/metrics"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// hasScope tells whether the rule only applies to some volumes.
+func (conf *Config) hasScope() bool {
+	return len(conf.Drivers)+len(conf.StorageClasses) > 0 || conf.StorageClassSelector != nil
+}
+
+// inScope tells whether the rule applies to the PV, or why not. Rules that
+// are gone apply to all PVs.
+func (c *Controller) inScope(rule string, pv *coreV1.PersistentVolume) (bool, string) {
+	conf := c.getRule(rule)
+	if conf == nil || !conf.hasScope() {
+		return true, ""
+	}
+	if len(conf.Drivers) > 0 {
+		if pv.Spec.CSI == nil {
+			return false, "it is not a CSI volume"
+		}
+		if !contains(conf.Drivers, pv.Spec.CSI.Driver) {
+			return false, fmt.Sprintf("its driver %s is not one of %v", pv.Spec.CSI.Driver, conf.Drivers)
+		}
+	}
+	class := pv.Spec.StorageClassName
+	if len(conf.StorageClasses) > 0 && !contains(conf.StorageClasses, class) {
+		return false, fmt.Sprintf("its storage class %q is not one of %v", class, conf.StorageClasses)
+	}
+	if conf.storageClassSelector != nil {
+		if len(class) == 0 {
+			return false, "it has no storage class"
+		}
+		sc, err := c.clientset.StorageV1().StorageClasses().Get(class, metaV1.GetOptions{})
+		if err != nil {
+			glog.Warningf("failed to get storage class %s: %v", class, err)
+			return false, fmt.Sprintf("its storage class %s can't be read: %v", class, err)
+		}
+		if !conf.storageClassSelector.Matches(labels.Set(sc.Labels)) {
+			return false, fmt.Sprintf("its storage class %s doesn't match the storage class selector", class)
+		}
+	}
+	return true, ""
+}
+
+// scopeAttributes drops the attributes of the rules that don't apply to the
+// PV, recording an event for each. Values of rules merged earlier that were
+// overridden by a dropped rule are not restored.
+func (c *Controller) scopeAttributes(pvc *coreV1.PersistentVolumeClaim, pv *coreV1.PersistentVolume, attrs *Attributes) *Attributes {
+	scoped := attrs
+	for _, rule := range attrs.Rules {
+		ok, reason := c.inScope(rule, pv)
+		if ok {
+			continue
+		}
+		glog.V(3).Infof("skipping rule %s for pv %s: %s", rule, pv.Name, reason)
+		metrics.RuleSkips.WithLabelValues(rule).Inc()
+		c.recorder.Eventf(pvc, coreV1.EventTypeNormal, EventRuleSkipped, "Rule %s not applied to PV %s, %s", rule, pv.Name, reason)
+		if scoped == attrs {
+			scoped = attrs.copy()
+		}
+		scoped.removeRule(rule)
+	}
+	return scoped
+}
+
+// removeRule removes a rule with the attributes it set.
+func (a *Attributes) removeRule(rule string) {
+	var rules []string
+	for _, r := range a.Rules {
+		if r != rule {
+			rules = append(rules, r)
+		}
+	}
+	a.Rules = rules
+	for k, r := range a.Sources {
+		if r == rule {
+			a.remove(k)
+		}
+	}
+	var patches []rulePatch
+	for _, p := range a.patches {
+		if p.Rule != rule {
+			patches = append(patches, p)
+		}
+	}
+	a.patches = patches
+	delete(a.strict, rule)
+	delete(a.failClosed, rule)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
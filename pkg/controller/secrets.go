@@ -0,0 +1,158 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// SecretValuesReference writes a reference to the Secret into the PV
+	// attributes, for CSI drivers that read the Secret themselves. It is the
+	// default.
+	SecretValuesReference = "reference"
+	// SecretValuesResolve writes the value read from the Secret into the PV
+	// attributes.
+	SecretValuesResolve = "resolve"
+
+	redactedValue = "<redacted>"
+)
+
+// SecretAttribute is an attribute whose value is read from a Secret.
+type SecretAttribute struct {
+	// Attribute is the name of the attribute.
+	Attribute    string            `json:"attribute"`
+	SecretKeyRef SecretKeySelector `json:"secretKeyRef"`
+}
+
+// SecretKeySelector selects a key of a Secret. The namespace defaults to the
+// namespace of the policy, or to the configuration namespace for cluster
+// policies and ConfigMap rules.
+type SecretKeySelector struct {
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	Key       string `json:"key"`
+}
+
+// secretValue is the value of a secret attribute until it is applied to a PV.
+type secretValue struct {
+	ref SecretKeySelector
+}
+
+// resolveSecretValues replaces the secret attributes by references to their
+// Secrets, or by the values read from them, depending on SecretValueMode.
+func (c *Controller) resolveSecretValues(values map[string]interface{}) (map[string]interface{}, error) {
+	resolved := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		secret, ok := v.(secretValue)
+		if !ok {
+			resolved[k] = v
+			continue
+		}
+		ref := secret.ref
+		if SecretValueMode != SecretValuesResolve {
+			resolved[k] = secretRefValue(ref.Namespace, ref.Name, ref.Key)
+			continue
+		}
+		s, err := c.clientset.CoreV1().Secrets(ref.Namespace).Get(ref.Name, metaV1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("attribute %s: failed to get secret %s/%s: %v", k, ref.Namespace, ref.Name, err)
+		}
+		data, ok := s.Data[ref.Key]
+		if !ok {
+			return nil, fmt.Errorf("attribute %s: secret %s/%s has no key %s", k, ref.Namespace, ref.Name, ref.Key)
+		}
+		resolved[k] = string(data)
+	}
+	return resolved, nil
+}
+
+// validateSecretAttributes checks the secret attributes of a rule and
+// defaults the namespaces of their Secrets.
+func validateSecretAttributes(conf *Config, attrs map[string]interface{}) error {
+	for i := range conf.SecretAttributes {
+		attr := &conf.SecretAttributes[i]
+		ref := &attr.SecretKeyRef
+		if len(attr.Attribute) == 0 {
+			return fmt.Errorf("rule %s: secret attribute without attribute", conf.Name)
+		}
+		if _, ok := attrs[attr.Attribute]; ok {
+			return fmt.Errorf("rule %s: %s is set more than once", conf.Name, attr.Attribute)
+		}
+		for _, key := range conf.GeneratedKeys {
+			if key.Attribute == attr.Attribute {
+				return fmt.Errorf("rule %s: %s is set more than once", conf.Name, attr.Attribute)
+			}
+		}
+		if len(ref.Name) == 0 || len(ref.Key) == 0 {
+			return fmt.Errorf("rule %s: secret attribute %s needs a secret name and key", conf.Name, attr.Attribute)
+		}
+		switch {
+		case len(conf.Namespace) > 0 && len(ref.Namespace) == 0:
+			ref.Namespace = conf.Namespace
+		case len(conf.Namespace) > 0 && ref.Namespace != conf.Namespace:
+			// tenants must not read the Secrets of other namespaces.
+			return fmt.Errorf("rule %s: secret attribute %s refers to another namespace", conf.Name, attr.Attribute)
+		case len(ref.Namespace) == 0:
+			ref.Namespace = IntializerNamespace
+		}
+	}
+	return nil
+}
+
+// isSensitive tells whether the value of an attribute of the rule must be
+// redacted.
+func (conf *Config) isSensitive(attribute string) bool {
+	for _, attr := range conf.SecretAttributes {
+		if attr.Attribute == attribute {
+			return true
+		}
+	}
+	for _, attr := range conf.Sensitive {
+		if attr == attribute {
+			return true
+		}
+	}
+	return false
+}
+
+// String implements fmt.Stringer, so that logging rules redacts their
+// sensitive attributes.
+func (conf Config) String() string {
+	if len(conf.Sensitive) > 0 {
+		attrs := map[string]interface{}{}
+		json.Unmarshal([]byte(conf.Attributes), &attrs)
+		for _, k := range conf.Sensitive {
+			if _, ok := attrs[k]; ok {
+				attrs[k] = redactedValue
+			}
+		}
+		data, _ := json.Marshal(attrs)
+		conf.Attributes = string(data)
+	}
+	type config Config
+	return fmt.Sprintf("%+v", config(conf))
+}
+
+// redact returns a copy of the values with the sensitive ones redacted, for
+// logging.
+func (a *Attributes) redact(values map[string]interface{}) map[string]interface{} {
+	redacted := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		if a.sensitive[k] {
+			v = redactedValue
+		}
+		redacted[k] = v
+	}
+	return redacted
+}
+
+// redactValue returns the value of an attribute, or a placeholder if it is
+// sensitive.
+func (a *Attributes) redactValue(attribute string, value interface{}) interface{} {
+	if a.sensitive[attribute] {
+		return redactedValue
+	}
+	return value
+}
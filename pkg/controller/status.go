@@ -0,0 +1,173 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/golang/glog"
+
+	"github.com/k8s-storage/dumbledore/pkg/apis/dumbledore/v1alpha1"
+	policyclient "github.com/k8s-storage/dumbledore/pkg/client/v1alpha1"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+// PolicyStatusUpdater periodically counts the PVs each policy is applied to,
+// as recorded by PolicyAnnotation, and reports the count in the policy status.
+// Policies involved in conflicts recorded by ConflictsAnnotation get the
+// Conflict condition, invalid policies the Invalid condition.
+type PolicyStatusUpdater struct {
+	clientset    *kubernetes.Clientset
+	policyClient *policyclient.DumbledoreV1alpha1Client
+	ctrl         *Controller
+}
+
+func NewPolicyStatusUpdater(clientset *kubernetes.Clientset, policyClient *policyclient.DumbledoreV1alpha1Client, ctrl *Controller) *PolicyStatusUpdater {
+	return &PolicyStatusUpdater{
+		clientset:    clientset,
+		policyClient: policyClient,
+		ctrl:         ctrl,
+	}
+}
+
+// validate returns why the policy is invalid, as the policy watcher does.
+func (u *PolicyStatusUpdater) validate(name, namespace string, spec *v1alpha1.PersistentVolumeAttributePolicySpec) error {
+	conf, err := specToConfig(name, namespace, spec)
+	if err != nil {
+		return err
+	}
+	return u.ctrl.ValidateRules([]Config{*conf})
+}
+
+func (u *PolicyStatusUpdater) Run(stop <-chan struct{}) {
+	wait.Until(u.sync, resyncPeriod, stop)
+}
+
+func (u *PolicyStatusUpdater) sync() {
+	pvs, err := u.clientset.CoreV1().PersistentVolumes().List(metaV1.ListOptions{})
+	if err != nil {
+		glog.Warningf("failed to list pvs: %v", err)
+		return
+	}
+	counts := map[string]int32{}
+	conflicts := map[string]int32{}
+	for _, pv := range pvs.Items {
+		if names, ok := pv.Annotations[PolicyAnnotation]; ok {
+			for _, name := range strings.Split(names, ",") {
+				counts[name]++
+			}
+		}
+		if data, ok := pv.Annotations[ConflictsAnnotation]; ok {
+			pvConflicts := map[string][]string{}
+			if err := json.Unmarshal([]byte(data), &pvConflicts); err != nil {
+				glog.Warningf("invalid conflicts on pv %s: %v", pv.Name, err)
+				continue
+			}
+			involved := map[string]bool{}
+			for _, rules := range pvConflicts {
+				for _, rule := range rules {
+					involved[rule] = true
+				}
+			}
+			for rule := range involved {
+				conflicts[rule]++
+			}
+		}
+	}
+
+	clusterPolicies, err := u.policyClient.ClusterPersistentVolumeAttributePolicies().List(metaV1.ListOptions{})
+	if err != nil {
+		glog.Warningf("failed to list cluster policies: %v", err)
+	} else {
+		for i := range clusterPolicies.Items {
+			p := &clusterPolicies.Items[i]
+			invalid := u.validate(p.Name, "", &p.Spec)
+			// the watcher keeps the last valid version in effect.
+			kept := invalid != nil && u.ctrl.getRule(p.Name) != nil
+			if status := newStatus(p.ObjectMeta, p.Status, counts[p.Name], conflicts[p.Name], invalid, kept); !reflect.DeepEqual(status, p.Status) {
+				p.Status = status
+				if _, err := u.policyClient.ClusterPersistentVolumeAttributePolicies().UpdateStatus(p); err != nil {
+					glog.Warningf("failed to update status of policy %s: %v", p.Name, err)
+				}
+			}
+		}
+	}
+
+	policies, err := u.policyClient.PersistentVolumeAttributePolicies(coreV1.NamespaceAll).List(metaV1.ListOptions{})
+	if err != nil {
+		glog.Warningf("failed to list policies: %v", err)
+		return
+	}
+	for i := range policies.Items {
+		p := &policies.Items[i]
+		name := p.Namespace + "/" + p.Name
+		invalid := u.validate(name, p.Namespace, &p.Spec)
+		kept := invalid != nil && u.ctrl.getRule(name) != nil
+		if status := newStatus(p.ObjectMeta, p.Status, counts[name], conflicts[name], invalid, kept); !reflect.DeepEqual(status, p.Status) {
+			p.Status = status
+			if _, err := u.policyClient.PersistentVolumeAttributePolicies(p.Namespace).UpdateStatus(p); err != nil {
+				glog.Warningf("failed to update status of policy %s/%s: %v", p.Namespace, p.Name, err)
+			}
+		}
+	}
+}
+
+func newStatus(meta metaV1.ObjectMeta, old v1alpha1.PersistentVolumeAttributePolicyStatus, pvs, conflicts int32, invalid error, kept bool) v1alpha1.PersistentVolumeAttributePolicyStatus {
+	status := v1alpha1.PersistentVolumeAttributePolicyStatus{
+		ObservedGeneration: meta.Generation,
+		PersistentVolumes:  pvs,
+	}
+	conflict := v1alpha1.PolicyCondition{
+		Type:    v1alpha1.ConditionConflict,
+		Status:  "False",
+		Reason:  "NoConflicts",
+		Message: "The attributes do not conflict with other policies",
+	}
+	if conflicts > 0 {
+		conflict.Status = "True"
+		conflict.Reason = "ConflictingAttributes"
+		conflict.Message = fmt.Sprintf("The attributes conflict with other policies on %d PVs", conflicts)
+	}
+	status.Conditions = setCondition(status.Conditions, old, conflict)
+	validity := v1alpha1.PolicyCondition{
+		Type:    v1alpha1.ConditionInvalid,
+		Status:  "False",
+		Reason:  "Valid",
+		Message: "The policy is applied",
+	}
+	if invalid != nil {
+		validity.Status = "True"
+		validity.Reason = "InvalidPolicy"
+		validity.Message = fmt.Sprintf("The policy is skipped: %v", invalid)
+		if kept {
+			validity.Message = fmt.Sprintf("The last valid version of the policy is applied: %v", invalid)
+		}
+	}
+	status.Conditions = setCondition(status.Conditions, old, validity)
+	return status
+}
+
+// setCondition appends the condition, keeping its last transition time if
+// its status didn't change. A condition that was never true is not reported.
+func setCondition(conditions []v1alpha1.PolicyCondition, old v1alpha1.PersistentVolumeAttributePolicyStatus, condition v1alpha1.PolicyCondition) []v1alpha1.PolicyCondition {
+	var oldCondition *v1alpha1.PolicyCondition
+	for i := range old.Conditions {
+		if old.Conditions[i].Type == condition.Type {
+			oldCondition = &old.Conditions[i]
+		}
+	}
+	switch {
+	case oldCondition == nil && condition.Status == "False":
+		return conditions
+	case oldCondition != nil && oldCondition.Status == condition.Status:
+		condition.LastTransitionTime = oldCondition.LastTransitionTime
+	default:
+		condition.LastTransitionTime = metaV1.Now()
+	}
+	return append(conditions, condition)
+}
@@ -0,0 +1,228 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+type Target string
+
+const (
+	// TargetAnnotation writes the attributes into the PV annotation set by
+	// -pv-annotation. It is the default.
+	TargetAnnotation Target = "annotation"
+	// TargetSpec writes the attributes into spec.csi.volumeAttributes of the
+	// PV, which the API server doesn't allow to change once the PV is bound.
+	TargetSpec Target = "spec"
+	// TargetBoth writes the attributes into both. If spec.csi can't be
+	// changed any more, only the annotation is written.
+	TargetBoth Target = "both"
+)
+
+// splitTargets splits the values into those written into the annotation and
+// those written into spec.csi.volumeAttributes.
+func (a *Attributes) splitTargets(values map[string]interface{}) (annotation, spec map[string]interface{}) {
+	annotation = map[string]interface{}{}
+	spec = map[string]interface{}{}
+	for k, v := range values {
+		switch a.targets[k] {
+		case TargetSpec:
+			spec[k] = v
+		case TargetBoth:
+			spec[k] = v
+			annotation[k] = v
+		default:
+			annotation[k] = v
+		}
+	}
+	return annotation, spec
+}
+
+// getVolumeAttributes reads spec.csi.volumeAttributes of the PV, which the
+// vendored API types lack.
+func (c *Controller) getVolumeAttributes(name string) (map[string]string, error) {
+	data, err := c.clientset.CoreV1().RESTClient().Get().Resource("persistentvolumes").Name(name).DoRaw()
+	if err != nil {
+		return nil, err
+	}
+	pv := struct {
+		Spec struct {
+			CSI *struct {
+				VolumeAttributes map[string]string `json:"volumeAttributes"`
+			} `json:"csi"`
+		} `json:"spec"`
+	}{}
+	if err := json.Unmarshal(data, &pv); err != nil {
+		return nil, err
+	}
+	if pv.Spec.CSI == nil {
+		return nil, nil
+	}
+	return pv.Spec.CSI.VolumeAttributes, nil
+}
+
+// specPatch returns the changes of spec.csi.volumeAttributes of the PV, null
+// removes an attribute. The merge strategies apply to all attributes already
+// in the spec. It returns a permanentError if the spec must be changed but
+// can't.
+func (c *Controller) specPatch(pv *coreV1.PersistentVolume, attrs *Attributes, values map[string]interface{}) (map[string]interface{}, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	if pv.Spec.CSI == nil {
+		return nil, &permanentError{fmt.Errorf("pv %s is not a CSI volume, it has no spec.csi.volumeAttributes", pv.Name)}
+	}
+	current, err := c.getVolumeAttributes(pv.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pv %s: %v", pv.Name, err)
+	}
+	patch := map[string]interface{}{}
+	for k, v := range values {
+		old, ok := current[k]
+		if v == nil {
+			if ok && attrs.strategies[k] != MergeKeepExisting {
+				patch[k] = nil
+			}
+			continue
+		}
+		s := volumeAttributeValue(v)
+		if ok {
+			switch attrs.strategies[k] {
+			case MergeKeepExisting:
+				continue
+			case MergeFailOnConflict:
+				if old != s {
+					return nil, &permanentError{fmt.Errorf("rule %s conflicts with %s=%v in spec.csi.volumeAttributes of pv %s", attrs.Sources[k], k, attrs.redactValue(k, old), pv.Name)}
+				}
+			}
+		}
+		if !ok || old != s {
+			patch[k] = s
+		}
+	}
+	if len(patch) == 0 || pv.Status.Phase != coreV1.VolumeBound {
+		return patch, nil
+	}
+	var rules []string
+	for k := range patch {
+		if attrs.targets[k] == TargetSpec {
+			rules = append(rules, attrs.Sources[k])
+		}
+	}
+	if len(rules) > 0 {
+		sort.Strings(rules)
+		return nil, &permanentError{fmt.Errorf("spec.csi.volumeAttributes of pv %s can't change once it is bound, rules %v must be applied before the claim is bound or target the annotation", pv.Name, rules)}
+	}
+	// only attributes written into both, the annotation is still written.
+	c.recorder.Eventf(pv, coreV1.EventTypeWarning, EventVolumeAttributesImmutable, "PV is bound, attributes %v only written into the annotation", patchKeysOf(patch))
+	return nil, nil
+}
+
+// volumeAttributeValue converts a value into a volume attribute, which can
+// only be a string. Other values are JSON encoded.
+func volumeAttributeValue(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return mustMarshal(v)
+}
+
+func patchKeysOf(patch map[string]interface{}) []string {
+	keys := make([]string, 0, len(patch))
+	for k := range patch {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// describeSpecChanges lists the changes of spec.csi.volumeAttributes, with the
+// sensitive values redacted.
+func (a *Attributes) describeSpecChanges(patch map[string]interface{}) string {
+	var changes []string
+	for _, k := range patchKeysOf(patch) {
+		if patch[k] == nil {
+			changes = append(changes, "removed "+k)
+			continue
+		}
+		changes = append(changes, fmt.Sprintf("%s=%v", k, a.redactValue(k, patch[k])))
+	}
+	return "spec.csi.volumeAttributes " + strings.Join(changes, ", ")
+}
+
+// updatePV writes the changes of the PV annotations since oldAnn and of
+// spec.csi.volumeAttributes with a merge patch. The PV is never updated as a
+// whole, the vendored API types would drop spec.csi.volumeAttributes.
+func (c *Controller) updatePV(pv *coreV1.PersistentVolume, oldAnn map[string]string, spec map[string]interface{}) error {
+	annotations := map[string]interface{}{}
+	for k, v := range pv.Annotations {
+		if old, ok := oldAnn[k]; !ok || old != v {
+			annotations[k] = v
+		}
+	}
+	for k := range oldAnn {
+		if _, ok := pv.Annotations[k]; !ok {
+			annotations[k] = nil
+		}
+	}
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			// fails with a conflict if the PV changed since it was read.
+			"resourceVersion": pv.ResourceVersion,
+			"annotations":     annotations,
+		},
+	}
+	if len(spec) > 0 {
+		patch["spec"] = map[string]interface{}{
+			"csi": map[string]interface{}{
+				"volumeAttributes": spec,
+			},
+		}
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	_, err = c.clientset.CoreV1().PersistentVolumes().Patch(pv.Name, types.MergePatchType, data)
+	return err
+}
+
+// prebindVolume returns the PV a claim that is not bound yet will be bound
+// to, if the attributes must be written into its spec: the PV named by the
+// claim, or the PV whose claimRef points to it. The PV must not be bound yet.
+func (c *Controller) prebindVolume(pvc *coreV1.PersistentVolumeClaim, attrs *Attributes) string {
+	spec := false
+	for _, t := range attrs.targets {
+		spec = spec || t == TargetSpec || t == TargetBoth
+	}
+	if !spec {
+		return ""
+	}
+	if len(pvc.Spec.VolumeName) > 0 {
+		pv, err := c.getPV(pvc.Spec.VolumeName)
+		if err != nil || pv.Status.Phase == coreV1.VolumeBound {
+			return ""
+		}
+		return pv.Name
+	}
+	for _, obj := range c.pvStore.List() {
+		pv := obj.(*coreV1.PersistentVolume)
+		ref := pv.Spec.ClaimRef
+		if ref != nil && ref.Namespace == pvc.Namespace && ref.Name == pvc.Name && (len(ref.UID) == 0 || ref.UID == pvc.UID) && pv.Status.Phase == coreV1.VolumeAvailable {
+			return pv.Name
+		}
+	}
+	return ""
+}
+
+func (conf *Config) target() Target {
+	if len(conf.Target) == 0 {
+		return TargetAnnotation
+	}
+	return conf.Target
+}
@@ -0,0 +1,265 @@
+package controller
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Attribute values containing "{{" are text/template templates, rendered for
+// every PV with the pod, its PVC, the PV and the pod's namespace. The objects
+// are exposed with their Go field names, e.g. {{ .Namespace.Labels.tenant }}.
+// Slices can be indexed as in {{ .Pod.Spec.Containers[0].Name }}.
+
+var (
+	actionRE = regexp.MustCompile(`{{.*?}}`)
+	indexRE  = regexp.MustCompile(`\[(\d+)\]`)
+
+	templateFuncs = template.FuncMap{
+		"default":     defaultValue,
+		"lower":       func(s interface{}) string { return strings.ToLower(fmt.Sprint(s)) },
+		"upper":       func(s interface{}) string { return strings.ToUpper(fmt.Sprint(s)) },
+		"sha256":      sha256Hex,
+		"addQuantity": addQuantity,
+		"subQuantity": subQuantity,
+		"mulQuantity": mulQuantity,
+		"divQuantity": divQuantity,
+	}
+)
+
+// missingValue is what text/template prints for missing map keys.
+const missingValue = "<no value>"
+
+type templateData struct {
+	Pod       interface{}
+	PVC       interface{}
+	PV        interface{}
+	Namespace interface{}
+}
+
+func newTemplateData(pod *coreV1.Pod, pvc *coreV1.PersistentVolumeClaim, pv *coreV1.PersistentVolume, ns *coreV1.Namespace) *templateData {
+	return &templateData{
+		Pod:       toTemplateValue(reflect.ValueOf(pod)),
+		PVC:       toTemplateValue(reflect.ValueOf(pvc)),
+		PV:        toTemplateValue(reflect.ValueOf(pv)),
+		Namespace: toTemplateValue(reflect.ValueOf(ns)),
+	}
+}
+
+func isTemplate(value interface{}) bool {
+	s, ok := value.(string)
+	return ok && strings.Contains(s, "{{")
+}
+
+func parseTemplate(name, text string) (*template.Template, error) {
+	text = actionRE.ReplaceAllStringFunc(text, rewriteIndexes)
+	return template.New(name).Funcs(templateFuncs).Option("missingkey=default").Parse(text)
+}
+
+// renderValues renders all templated values. It fails if any of them fails,
+// so that no partial attributes are applied.
+func renderValues(values map[string]interface{}, data *templateData) (map[string]interface{}, error) {
+	rendered := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		if !isTemplate(v) {
+			rendered[k] = v
+			continue
+		}
+		tmpl, err := parseTemplate(k, v.(string))
+		if err != nil {
+			return nil, fmt.Errorf("attribute %s: %v", k, err)
+		}
+		buf := &bytes.Buffer{}
+		if err := tmpl.Execute(buf, data); err != nil {
+			return nil, fmt.Errorf("attribute %s: %v", k, err)
+		}
+		if strings.Contains(buf.String(), missingValue) {
+			// the template is not quoted, it may be sensitive.
+			return nil, fmt.Errorf("attribute %s: template refers to a missing value", k)
+		}
+		rendered[k] = buf.String()
+	}
+	return rendered, nil
+}
+
+// rewriteIndexes rewrites a.b[0].c, which text/template lacks, into
+// (index a.b 0).c in a template action.
+func rewriteIndexes(action string) string {
+	for {
+		loc := indexRE.FindStringSubmatchIndex(action)
+		if loc == nil {
+			return action
+		}
+		start := loc[0]
+		for start > 0 {
+			ch := action[start-1]
+			if ch == ')' {
+				// the operand is a parenthesized pipeline, e.g. an index
+				// rewritten before.
+				depth := 0
+				for start > 0 {
+					start--
+					if action[start] == ')' {
+						depth++
+					} else if action[start] == '(' {
+						depth--
+						if depth == 0 {
+							break
+						}
+					}
+				}
+				break
+			}
+			if ch != '.' && ch != '$' && ch != '_' && !isAlphanumeric(ch) {
+				break
+			}
+			start--
+		}
+		action = action[:start] + "(index " + action[start:loc[0]] + " " + action[loc[2]:loc[3]] + ")" + action[loc[1]:]
+	}
+}
+
+func isAlphanumeric(ch byte) bool {
+	return ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9'
+}
+
+// toTemplateValue converts an API object into maps keyed by Go field names,
+// so that map keys of named string types, like the resource names of a
+// ResourceList, can be looked up in templates. Quantities and times become
+// strings.
+func toTemplateValue(v reflect.Value) interface{} {
+	switch v.Kind() {
+	case reflect.Invalid:
+		return nil
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return toTemplateValue(v.Elem())
+	}
+	switch val := v.Interface().(type) {
+	case resource.Quantity:
+		return val.String()
+	case metaV1.Time:
+		return val.UTC().Format(time.RFC3339)
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		m := map[string]interface{}{}
+		addFields(m, v)
+		return m
+	case reflect.Map:
+		m := make(map[string]interface{}, v.Len())
+		for _, key := range v.MapKeys() {
+			m[fmt.Sprint(key.Interface())] = toTemplateValue(v.MapIndex(key))
+		}
+		return m
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return string(v.Bytes())
+		}
+		s := make([]interface{}, v.Len())
+		for i := range s {
+			s[i] = toTemplateValue(v.Index(i))
+		}
+		return s
+	}
+	return v.Interface()
+}
+
+// addFields adds the exported fields of a struct, fields of embedded structs
+// like ObjectMeta are promoted.
+func addFields(m map[string]interface{}, v reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if len(field.PkgPath) > 0 {
+			continue
+		}
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			addFields(m, v.Field(i))
+			continue
+		}
+		m[field.Name] = toTemplateValue(v.Field(i))
+	}
+}
+
+// defaultValue returns value, or fallback if it is missing or empty, as in
+// {{ .Namespace.Labels.tenant | default "none" }}.
+func defaultValue(fallback, value interface{}) interface{} {
+	if value == nil || value == "" {
+		return fallback
+	}
+	return value
+}
+
+func sha256Hex(value interface{}) string {
+	sum := sha256.Sum256([]byte(fmt.Sprint(value)))
+	return hex.EncodeToString(sum[:])
+}
+
+func toQuantity(value interface{}) (resource.Quantity, error) {
+	if q, ok := value.(resource.Quantity); ok {
+		return q, nil
+	}
+	return resource.ParseQuantity(fmt.Sprint(value))
+}
+
+func addQuantity(a, b interface{}) (string, error) {
+	x, err := toQuantity(a)
+	if err != nil {
+		return "", err
+	}
+	y, err := toQuantity(b)
+	if err != nil {
+		return "", err
+	}
+	x.Add(y)
+	return x.String(), nil
+}
+
+func subQuantity(a, b interface{}) (string, error) {
+	x, err := toQuantity(a)
+	if err != nil {
+		return "", err
+	}
+	y, err := toQuantity(b)
+	if err != nil {
+		return "", err
+	}
+	x.Sub(y)
+	return x.String(), nil
+}
+
+func mulQuantity(a interface{}, factor int64) (string, error) {
+	x, err := toQuantity(a)
+	if err != nil {
+		return "", err
+	}
+	milli := x.MilliValue()
+	if factor != 0 && milli*factor/factor != milli {
+		return "", fmt.Errorf("%s * %d overflows", x.String(), factor)
+	}
+	return resource.NewMilliQuantity(milli*factor, x.Format).String(), nil
+}
+
+func divQuantity(a interface{}, divisor int64) (string, error) {
+	x, err := toQuantity(a)
+	if err != nil {
+		return "", err
+	}
+	if divisor == 0 {
+		return "", fmt.Errorf("division of %s by zero", x.String())
+	}
+	return resource.NewMilliQuantity(x.MilliValue()/divisor, x.Format).String(), nil
+}
@@ -0,0 +1,90 @@
+package controller
+
+import (
+	"strings"
+	"testing"
+
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRewriteIndexes(t *testing.T) {
+	tests := []struct {
+		action string
+		want   string
+	}{
+		{"{{ .Pod.Name }}", "{{ .Pod.Name }}"},
+		{"{{ .Pod.Spec.Containers[0].Name }}", "{{ (index .Pod.Spec.Containers 0).Name }}"},
+		{"{{ .Pod.Spec.Containers[1].Ports[0].ContainerPort }}", "{{ (index (index .Pod.Spec.Containers 1).Ports 0).ContainerPort }}"},
+		{"{{ .Matrix[0][1] }}", "{{ (index (index .Matrix 0) 1) }}"},
+		{"{{ $c := .Pod.Spec.Containers[0] }}", "{{ $c := (index .Pod.Spec.Containers 0) }}"},
+		{"{{ $.Pod.Spec.Volumes[2].Name }}", "{{ (index $.Pod.Spec.Volumes 2).Name }}"},
+		{"{{ lower (.Pod.Spec.Containers[0].Name) }}", "{{ lower ((index .Pod.Spec.Containers 0).Name) }}"},
+		{"{{ mulQuantity .Pod.Spec.Containers[0].Resources.Requests.memory 2 }}", "{{ mulQuantity (index .Pod.Spec.Containers 0).Resources.Requests.memory 2 }}"},
+	}
+	for _, test := range tests {
+		if got := rewriteIndexes(test.action); got != test.want {
+			t.Errorf("rewriteIndexes(%q) = %q, want %q", test.action, got, test.want)
+		}
+	}
+}
+
+func TestRenderValues(t *testing.T) {
+	pod := &coreV1.Pod{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:      "db-0",
+			Namespace: "team-a",
+			Labels:    map[string]string{"app": "database"},
+		},
+		Spec: coreV1.PodSpec{
+			Containers: []coreV1.Container{
+				{
+					Name: "db",
+					Resources: coreV1.ResourceRequirements{
+						Requests: coreV1.ResourceList{
+							coreV1.ResourceMemory: resource.MustParse("1Gi"),
+						},
+					},
+				},
+				{
+					Name:  "exporter",
+					Ports: []coreV1.ContainerPort{{ContainerPort: 9100}, {ContainerPort: 9101}},
+				},
+			},
+		},
+	}
+	pvc := &coreV1.PersistentVolumeClaim{ObjectMeta: metaV1.ObjectMeta{Name: "data-db-0", Namespace: "team-a"}}
+	pv := &coreV1.PersistentVolume{ObjectMeta: metaV1.ObjectMeta{Name: "pv-1"}}
+	ns := &coreV1.Namespace{ObjectMeta: metaV1.ObjectMeta{Name: "team-a", Labels: map[string]string{"tenant": "Acme"}}}
+	data := newTemplateData(pod, pvc, pv, ns)
+
+	tests := []struct {
+		value string
+		want  string
+		err   string
+	}{
+		{value: "{{ .Pod.Spec.Containers[0].Resources.Requests.memory }}", want: "1Gi"},
+		{value: "{{ mulQuantity .Pod.Spec.Containers[0].Resources.Requests.memory 2 }}", want: "2Gi"},
+		{value: "{{ .Pod.Spec.Containers[1].Ports[1].ContainerPort }}", want: "9101"},
+		{value: "{{ $c := .Pod.Spec.Containers[1] }}{{ $c.Name }}", want: "exporter"},
+		{value: "{{ .Namespace.Labels.tenant | lower }}-{{ .PVC.Name }}", want: "acme-data-db-0"},
+		{value: "{{ .Namespace.Labels.missing | default \"shared\" }}", want: "shared"},
+		{value: "{{ .Namespace.Labels.missing }}", err: "missing value"},
+		{value: "{{ .Pod.Spec.Containers[0].Resources.Limits.memory }}", err: "missing value"},
+		{value: "{{ .Pod.Spec.Containers[5].Name }}", err: "out of range"},
+	}
+	for _, test := range tests {
+		rendered, err := renderValues(map[string]interface{}{"attr": test.value}, data)
+		switch {
+		case len(test.err) > 0:
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("rendering %q: got error %v, want %q", test.value, err, test.err)
+			}
+		case err != nil:
+			t.Errorf("rendering %q: %v", test.value, err)
+		case rendered["attr"] != test.want:
+			t.Errorf("rendering %q = %q, want %q", test.value, rendered["attr"], test.want)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+// Package leaderelection elects a leader among the replicas with client-go's
+// leader election on a coordination.k8s.io Lease. The vendored client-go
+// predates the Lease API, so the lock reads and writes the Lease through the
+// raw REST path.
+package leaderelection
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	leaseAPIVersion = "coordination.k8s.io/v1"
+	leasePath       = "/apis/coordination.k8s.io/v1/namespaces"
+)
+
+type Config struct {
+	// Namespace and Name locate the Lease.
+	Namespace string
+	Name      string
+	// Identity is the unique name of this replica.
+	Identity string
+	// LeaseDuration is how long the other replicas wait after the last
+	// renewal before they take over.
+	LeaseDuration time.Duration
+	// RenewDeadline is how long the leader retries to renew the lease
+	// before it gives up leadership.
+	RenewDeadline time.Duration
+	// RetryPeriod is the interval of the attempts to acquire or renew.
+	RetryPeriod time.Duration
+
+	// OnStartedLeading is called when this replica becomes the leader. It
+	// must return once stop is closed, after handing over its state.
+	OnStartedLeading func(stop <-chan struct{})
+	// OnStoppedLeading is called once this replica lost the lease and
+	// OnStartedLeading returned.
+	OnStoppedLeading func()
+}
+
+// Run waits until this replica becomes the leader and leads until stop is
+// closed or the lease can't be renewed. Once stop is closed it returns when
+// the leader handed over its state. The lease is not released, the other
+// replicas take over once it expires.
+func Run(clientset *kubernetes.Clientset, recorder record.EventRecorder, config Config, stop <-chan struct{}) error {
+	lock := &LeaseLock{
+		LeaseMeta: metaV1.ObjectMeta{Namespace: config.Namespace, Name: config.Name},
+		Client:    clientset.CoreV1().RESTClient(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity:      config.Identity,
+			EventRecorder: recorder,
+		},
+	}
+	leading := make(chan struct{})
+	done := make(chan struct{})
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: config.LeaseDuration,
+		RenewDeadline: config.RenewDeadline,
+		RetryPeriod:   config.RetryPeriod,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(lost <-chan struct{}) {
+				close(leading)
+				defer close(done)
+				leaderStop := make(chan struct{})
+				go func() {
+					select {
+					case <-stop:
+					case <-lost:
+					}
+					close(leaderStop)
+				}()
+				config.OnStartedLeading(leaderStop)
+			},
+			OnStoppedLeading: func() {
+				<-done
+				glog.Infof("%s stopped leading", config.Identity)
+				config.OnStoppedLeading()
+			},
+			OnNewLeader: func(identity string) {
+				glog.Infof("%s is the leader", identity)
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	go elector.Run()
+
+	<-stop
+	select {
+	case <-leading:
+		<-done
+	default:
+	}
+	return nil
+}
+
+// LeaseLock is a resourcelock.Interface on a Lease.
+type LeaseLock struct {
+	// LeaseMeta has the Name and Namespace of the Lease.
+	LeaseMeta  metaV1.ObjectMeta
+	Client     rest.Interface
+	LockConfig resourcelock.ResourceLockConfig
+	lease      *lease
+}
+
+// lease is the part of a coordination.k8s.io/v1 Lease the lock uses.
+type lease struct {
+	metaV1.TypeMeta   `json:",inline"`
+	metaV1.ObjectMeta `json:"metadata"`
+	Spec              leaseSpec `json:"spec"`
+}
+
+type leaseSpec struct {
+	HolderIdentity       *string           `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds *int32            `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          *metaV1.MicroTime `json:"acquireTime,omitempty"`
+	RenewTime            *metaV1.MicroTime `json:"renewTime,omitempty"`
+	LeaseTransitions     *int32            `json:"leaseTransitions,omitempty"`
+}
+
+// Get returns the election record of the Lease.
+func (l *LeaseLock) Get() (*resourcelock.LeaderElectionRecord, error) {
+	raw, err := l.Client.Get().AbsPath(leasePath, l.LeaseMeta.Namespace, "leases", l.LeaseMeta.Name).Do().Raw()
+	if err != nil {
+		return nil, err
+	}
+	ls := &lease{}
+	if err := json.Unmarshal(raw, ls); err != nil {
+		return nil, fmt.Errorf("invalid lease %s: %v", l.Describe(), err)
+	}
+	l.lease = ls
+	return leaseToRecord(&ls.Spec), nil
+}
+
+// Create creates the Lease with the record.
+func (l *LeaseLock) Create(ler resourcelock.LeaderElectionRecord) error {
+	ls := &lease{
+		TypeMeta:   metaV1.TypeMeta{APIVersion: leaseAPIVersion, Kind: "Lease"},
+		ObjectMeta: metaV1.ObjectMeta{Namespace: l.LeaseMeta.Namespace, Name: l.LeaseMeta.Name},
+		Spec:       recordToLease(&ler),
+	}
+	data, err := json.Marshal(ls)
+	if err != nil {
+		return err
+	}
+	raw, err := l.Client.Post().AbsPath(leasePath, l.LeaseMeta.Namespace, "leases").SetHeader("Content-Type", "application/json").Body(data).Do().Raw()
+	if err != nil {
+		return err
+	}
+	return l.decode(raw)
+}
+
+// Update writes the record, it fails if the Lease changed since it was read.
+func (l *LeaseLock) Update(ler resourcelock.LeaderElectionRecord) error {
+	if l.lease == nil {
+		return errors.New("lease not initialized, call get or create first")
+	}
+	ls := *l.lease
+	ls.TypeMeta = metaV1.TypeMeta{APIVersion: leaseAPIVersion, Kind: "Lease"}
+	ls.Spec = recordToLease(&ler)
+	data, err := json.Marshal(&ls)
+	if err != nil {
+		return err
+	}
+	raw, err := l.Client.Put().AbsPath(leasePath, l.LeaseMeta.Namespace, "leases", l.LeaseMeta.Name).SetHeader("Content-Type", "application/json").Body(data).Do().Raw()
+	if err != nil {
+		return err
+	}
+	return l.decode(raw)
+}
+
+func (l *LeaseLock) decode(raw []byte) error {
+	ls := &lease{}
+	if err := json.Unmarshal(raw, ls); err != nil {
+		return fmt.Errorf("invalid lease %s: %v", l.Describe(), err)
+	}
+	l.lease = ls
+	return nil
+}
+
+// RecordEvent records an event on the Lease.
+func (l *LeaseLock) RecordEvent(s string) {
+	if l.LockConfig.EventRecorder == nil {
+		return
+	}
+	ref := &coreV1.ObjectReference{
+		APIVersion: leaseAPIVersion,
+		Kind:       "Lease",
+		Namespace:  l.LeaseMeta.Namespace,
+		Name:       l.LeaseMeta.Name,
+	}
+	if l.lease != nil {
+		ref.UID = l.lease.UID
+	}
+	l.LockConfig.EventRecorder.Eventf(ref, coreV1.EventTypeNormal, "LeaderElection", "%v %v", l.LockConfig.Identity, s)
+}
+
+// Describe returns the namespace and name of the Lease.
+func (l *LeaseLock) Describe() string {
+	return fmt.Sprintf("%v/%v", l.LeaseMeta.Namespace, l.LeaseMeta.Name)
+}
+
+// Identity returns the identity of this replica.
+func (l *LeaseLock) Identity() string {
+	return l.LockConfig.Identity
+}
+
+func leaseToRecord(spec *leaseSpec) *resourcelock.LeaderElectionRecord {
+	r := &resourcelock.LeaderElectionRecord{}
+	if spec.HolderIdentity != nil {
+		r.HolderIdentity = *spec.HolderIdentity
+	}
+	if spec.LeaseDurationSeconds != nil {
+		r.LeaseDurationSeconds = int(*spec.LeaseDurationSeconds)
+	}
+	if spec.LeaseTransitions != nil {
+		r.LeaderTransitions = int(*spec.LeaseTransitions)
+	}
+	if spec.AcquireTime != nil {
+		r.AcquireTime = metaV1.Time{Time: spec.AcquireTime.Time}
+	}
+	if spec.RenewTime != nil {
+		r.RenewTime = metaV1.Time{Time: spec.RenewTime.Time}
+	}
+	return r
+}
+
+func recordToLease(r *resourcelock.LeaderElectionRecord) leaseSpec {
+	duration := int32(r.LeaseDurationSeconds)
+	transitions := int32(r.LeaderTransitions)
+	acquire := metaV1.MicroTime{Time: r.AcquireTime.Time}
+	renew := metaV1.MicroTime{Time: r.RenewTime.Time}
+	return leaseSpec{
+		HolderIdentity:       &r.HolderIdentity,
+		LeaseDurationSeconds: &duration,
+		AcquireTime:          &acquire,
+		RenewTime:            &renew,
+		LeaseTransitions:     &transitions,
+	}
+}
@@ -0,0 +1,142 @@
+// Package metrics defines the metrics of dumbledore and serves them in the
+// Prometheus text format.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	// PodsInitialized counts the pods handed to the controller, by mode,
+	// "initializer" or "webhook".
+	PodsInitialized = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dumbledore_pods_initialized_total",
+		Help: "Number of pods initialized.",
+	}, []string{"mode"})
+	// PodInitializationDuration is the time from the creation of a pod until
+	// the initializer is done with it, or the time the webhook took to admit
+	// it.
+	PodInitializationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dumbledore_pod_initialization_duration_seconds",
+		Help:    "Latency of pod initialization in seconds.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"mode"})
+	// RuleMatches counts the pods matched per rule.
+	RuleMatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dumbledore_rule_matches_total",
+		Help: "Number of pods matched by a rule.",
+	}, []string{"rule"})
+	// RuleSkips counts the PVs a rule was skipped for because it is scoped to
+	// other drivers or storage classes.
+	RuleSkips = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dumbledore_rule_skips_total",
+		Help: "Number of PVs a rule was skipped for by its scope.",
+	}, []string{"rule"})
+	// ClaimMutations counts the claims mutated per rule when they are
+	// created.
+	ClaimMutations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dumbledore_claim_mutations_total",
+		Help: "Number of claims mutated by a rule when they are created.",
+	}, []string{"rule"})
+	// Enforcements counts the pods waiting for the attributes of strict or
+	// fail-closed rules by result, "enforced", or "failed" or "timeout"
+	// followed by "_allowed" or "_rejected".
+	Enforcements = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dumbledore_enforcements_total",
+		Help: "Number of pods waiting for their attributes by result.",
+	}, []string{"result"})
+	// ClaimConflicts counts the conflicts between pods sharing a claim by
+	// resolution, "rejected", "kept_existing" or "overridden".
+	ClaimConflicts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dumbledore_claim_conflicts_total",
+		Help: "Number of conflicting attributes of pods sharing a claim by resolution.",
+	}, []string{"resolution"})
+	// ProtectedAttributeViolations counts the attempts to change protected
+	// attributes by kind, "immutable" or "monotonic".
+	ProtectedAttributeViolations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dumbledore_protected_attribute_violations_total",
+		Help: "Number of attempts to change protected attributes by kind.",
+	}, []string{"kind"})
+	// PVPatchAttempts counts the attempts to apply attributes to a PV.
+	PVPatchAttempts = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dumbledore_pv_patch_attempts_total",
+		Help: "Number of attempts to apply attributes to a PV.",
+	})
+	// PVPatches counts the outcomes of the attempts by result, "succeeded" or
+	// "failed", and the reason of failures.
+	PVPatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dumbledore_pv_patches_total",
+		Help: "Number of PV patches by result and reason.",
+	}, []string{"result", "reason"})
+	// PrunedAttributes counts the attributes removed from PVs because their
+	// rules no longer set them.
+	PrunedAttributes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dumbledore_pruned_attributes_total",
+		Help: "Number of attributes removed from PVs because their rules no longer set them.",
+	})
+	// PendingPVCs is the number of claims waiting for their attributes.
+	PendingPVCs = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "dumbledore_pending_pvcs",
+		Help: "Number of PVCs with attributes pending.",
+	})
+	// WorkqueueDepth is the number of queued items.
+	WorkqueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "dumbledore_workqueue_depth",
+		Help: "Number of items in the work queue.",
+	})
+	// WorkqueueRetries counts the items queued again after a failure.
+	WorkqueueRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dumbledore_workqueue_retries_total",
+		Help: "Number of retries of failed work queue items.",
+	})
+	// ConfigReloads counts the reloads of the rules by result, "success",
+	// "partial" if invalid policies were skipped, or "failure".
+	ConfigReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dumbledore_config_reloads_total",
+		Help: "Number of rule reloads by result.",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		PodsInitialized,
+		PodInitializationDuration,
+		RuleMatches,
+		RuleSkips,
+		ClaimMutations,
+		Enforcements,
+		ClaimConflicts,
+		ProtectedAttributeViolations,
+		PVPatchAttempts,
+		PVPatches,
+		PrunedAttributes,
+		PendingPVCs,
+		WorkqueueDepth,
+		WorkqueueRetries,
+		ConfigReloads,
+	)
+}
+
+// Handler serves the registered metrics.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Reasons of failed PV patches.
+const (
+	ReasonGetPV            = "get_pv"
+	ReasonRender           = "render"
+	ReasonKeyGeneration    = "key_generation"
+	ReasonSecret           = "secret"
+	ReasonParse            = "parse"
+	ReasonMergeConflict    = "merge_conflict"
+	ReasonProtected        = "protected"
+	ReasonPatch            = "patch"
+	ReasonSchema           = "schema"
+	ReasonVolumeAttributes = "volume_attributes"
+	ReasonUpdate           = "update"
+	ReasonConflict         = "update_conflict"
+)
@@ -0,0 +1,38 @@
+package metrics
+
+import (
+	"k8s.io/client-go/util/workqueue"
+)
+
+func init() {
+	workqueue.SetProvider(workqueueMetrics{})
+}
+
+// workqueueMetrics reports the depth and retries of the work queues.
+type workqueueMetrics struct{}
+
+func (workqueueMetrics) NewDepthMetric(name string) workqueue.GaugeMetric {
+	return WorkqueueDepth
+}
+
+func (workqueueMetrics) NewAddsMetric(name string) workqueue.CounterMetric {
+	return noopMetric{}
+}
+
+func (workqueueMetrics) NewLatencyMetric(name string) workqueue.SummaryMetric {
+	return noopMetric{}
+}
+
+func (workqueueMetrics) NewWorkDurationMetric(name string) workqueue.SummaryMetric {
+	return noopMetric{}
+}
+
+func (workqueueMetrics) NewRetriesMetric(name string) workqueue.CounterMetric {
+	return WorkqueueRetries
+}
+
+type noopMetric struct{}
+
+func (noopMetric) Inc()            {}
+func (noopMetric) Dec()            {}
+func (noopMetric) Observe(float64) {}
@@ -0,0 +1,50 @@
+package webhook
+
+import (
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// The admission.k8s.io types are not part of the vendored k8s.io/api, so the
+// subset of the AdmissionReview wire format used by the webhook is mirrored
+// here. It is identical for admission.k8s.io/v1 and v1beta1.
+
+type Operation string
+
+const (
+	Create Operation = "CREATE"
+	Update Operation = "UPDATE"
+	Delete Operation = "DELETE"
+)
+
+type PatchType string
+
+const PatchTypeJSONPatch PatchType = "JSONPatch"
+
+type AdmissionReview struct {
+	metaV1.TypeMeta `json:",inline"`
+	Request         *AdmissionRequest  `json:"request,omitempty"`
+	Response        *AdmissionResponse `json:"response,omitempty"`
+}
+
+type AdmissionRequest struct {
+	UID         types.UID                   `json:"uid"`
+	Kind        metaV1.GroupVersionKind     `json:"kind"`
+	Resource    metaV1.GroupVersionResource `json:"resource"`
+	SubResource string                      `json:"subResource,omitempty"`
+	Name        string                      `json:"name,omitempty"`
+	Namespace   string                      `json:"namespace,omitempty"`
+	Operation   Operation                   `json:"operation"`
+	Object      runtime.RawExtension        `json:"object,omitempty"`
+	OldObject   runtime.RawExtension        `json:"oldObject,omitempty"`
+	DryRun      *bool                       `json:"dryRun,omitempty"`
+}
+
+type AdmissionResponse struct {
+	UID       types.UID      `json:"uid"`
+	Allowed   bool           `json:"allowed"`
+	Result    *metaV1.Status `json:"status,omitempty"`
+	Patch     []byte         `json:"patch,omitempty"`
+	PatchType *PatchType     `json:"patchType,omitempty"`
+}
@@ -0,0 +1,228 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/k8s-storage/dumbledore/pkg/controller"
+	"github.com/k8s-storage/dumbledore/pkg/metrics"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	MutatePodsPath   = "/mutate-pods"
+	MutateClaimsPath = "/mutate-claims"
+)
+
+// Server is the mutating admission webhook that replaces the removed pod
+// initializer. It runs the same label-to-attribute logic on Pod CREATE and
+// admits the pod, unless it is matched by a strict or fail-closed rule whose
+// attributes are not applied in time. On PersistentVolumeClaim CREATE it sets
+// the storage class and annotations of the matching rules.
+type Server struct {
+	ctrl *controller.Controller
+}
+
+func NewServer(ctrl *controller.Controller) *Server {
+	return &Server{ctrl: ctrl}
+}
+
+// Handler returns the HTTP handler serving the webhook paths.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(MutatePodsPath, s.servePods)
+	mux.HandleFunc(MutateClaimsPath, s.serveClaims)
+	return mux
+}
+
+func (s *Server) servePods(w http.ResponseWriter, r *http.Request) {
+	review, err := readReview(r)
+	if err != nil {
+		glog.Warningf("failed to read admission review: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	review.Response = s.admitPod(review.Request)
+	review.Request = nil
+	writeReview(w, review)
+}
+
+func (s *Server) admitPod(req *AdmissionRequest) *AdmissionResponse {
+	resp := &AdmissionResponse{UID: req.UID, Allowed: true}
+	if req.Kind.Kind != "Pod" || req.Operation != Create {
+		return resp
+	}
+	if req.DryRun != nil && *req.DryRun {
+		// PV updates are side effects, skip them for dry runs.
+		return resp
+	}
+
+	pod := &coreV1.Pod{}
+	if err := json.Unmarshal(req.Object.Raw, pod); err != nil {
+		glog.Warningf("failed to decode pod: %v", err)
+		return resp
+	}
+	// Pods created by controllers have no name and usually no namespace yet.
+	if len(pod.Namespace) == 0 {
+		pod.Namespace = req.Namespace
+	}
+	glog.V(3).Infof("Admitting: %s/%s", pod.Namespace, podName(pod))
+	start := time.Now()
+	admission := s.ctrl.AdmitPod(pod)
+	if err := admission.Enforce(controller.EnforcementTimeout); err != nil {
+		glog.Warningf("rejecting pod %s/%s: %v", pod.Namespace, podName(pod), err)
+		resp.Allowed = false
+		resp.Result = &metaV1.Status{
+			Status:  metaV1.StatusFailure,
+			Message: err.Error(),
+			Reason:  metaV1.StatusReasonForbidden,
+			Code:    http.StatusForbidden,
+		}
+	}
+	metrics.PodsInitialized.WithLabelValues("webhook").Inc()
+	metrics.PodInitializationDuration.WithLabelValues("webhook").Observe(time.Since(start).Seconds())
+	return resp
+}
+
+func (s *Server) serveClaims(w http.ResponseWriter, r *http.Request) {
+	review, err := readReview(r)
+	if err != nil {
+		glog.Warningf("failed to read admission review: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	review.Response = s.admitClaim(review.Request)
+	review.Request = nil
+	writeReview(w, review)
+}
+
+// admitClaim admits the claim with the storage class and annotations of the
+// matching rules, or rejects it if a fail-closed rule can't be evaluated. Dry
+// runs are mutated as well, without the events and metrics.
+func (s *Server) admitClaim(req *AdmissionRequest) *AdmissionResponse {
+	resp := &AdmissionResponse{UID: req.UID, Allowed: true}
+	if req.Kind.Kind != "PersistentVolumeClaim" || req.Operation != Create {
+		return resp
+	}
+	pvc := &coreV1.PersistentVolumeClaim{}
+	if err := json.Unmarshal(req.Object.Raw, pvc); err != nil {
+		glog.Warningf("failed to decode claim: %v", err)
+		return resp
+	}
+	if len(pvc.Namespace) == 0 {
+		pvc.Namespace = req.Namespace
+	}
+	orig := pvc.DeepCopy()
+	dryRun := req.DryRun != nil && *req.DryRun
+	rules, err := s.ctrl.MutateClaim(pvc, dryRun)
+	if err != nil {
+		glog.Warningf("rejecting claim %s/%s: %v", pvc.Namespace, pvc.Name, err)
+		resp.Allowed = false
+		resp.Result = &metaV1.Status{
+			Status:  metaV1.StatusFailure,
+			Message: err.Error(),
+			Reason:  metaV1.StatusReasonForbidden,
+			Code:    http.StatusForbidden,
+		}
+		return resp
+	}
+	if len(rules) == 0 {
+		return resp
+	}
+	patch, err := json.Marshal(claimPatch(orig, pvc))
+	if err != nil {
+		glog.Warningf("failed to encode patch of claim %s/%s: %v", pvc.Namespace, pvc.Name, err)
+		return resp
+	}
+	patchType := PatchTypeJSONPatch
+	resp.Patch = patch
+	resp.PatchType = &patchType
+	return resp
+}
+
+// claimPatch returns the JSON Patch changing the storage class and
+// annotations of the claim from orig to pvc.
+func claimPatch(orig, pvc *coreV1.PersistentVolumeClaim) []controller.PatchOperation {
+	var ops []controller.PatchOperation
+	if class := pvc.Spec.StorageClassName; class != nil && (orig.Spec.StorageClassName == nil || *orig.Spec.StorageClassName != *class) {
+		ops = append(ops, patchOperation("add", "/spec/storageClassName", *class))
+	}
+	if orig.Annotations == nil {
+		return append(ops, patchOperation("add", "/metadata/annotations", pvc.Annotations))
+	}
+	keys := make([]string, 0, len(pvc.Annotations))
+	for k := range pvc.Annotations {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if old, ok := orig.Annotations[k]; !ok || old != pvc.Annotations[k] {
+			ops = append(ops, patchOperation("add", "/metadata/annotations/"+escapePointer(k), pvc.Annotations[k]))
+		}
+	}
+	return ops
+}
+
+func patchOperation(op, path string, value interface{}) controller.PatchOperation {
+	data, _ := json.Marshal(value)
+	return controller.PatchOperation{Op: op, Path: path, Value: data}
+}
+
+// escapePointer escapes a key for a JSON Pointer, RFC 6901.
+func escapePointer(key string) string {
+	return strings.Replace(strings.Replace(key, "~", "~0", -1), "/", "~1", -1)
+}
+
+func podName(pod *coreV1.Pod) string {
+	if len(pod.Name) > 0 {
+		return pod.Name
+	}
+	return pod.GenerateName
+}
+
+func readReview(r *http.Request) (*AdmissionReview, error) {
+	if r.Method != http.MethodPost {
+		return nil, fmt.Errorf("unexpected method %s", r.Method)
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+		return nil, fmt.Errorf("unexpected content type %q", ct)
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	review := &AdmissionReview{}
+	if err := json.Unmarshal(body, review); err != nil {
+		return nil, err
+	}
+	if review.Request == nil {
+		return nil, fmt.Errorf("admission review has no request")
+	}
+	return review, nil
+}
+
+func writeReview(w http.ResponseWriter, review *AdmissionReview) {
+	// The response must be of the same version as the request.
+	if len(review.APIVersion) == 0 {
+		review.TypeMeta = metaV1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"}
+	}
+	data, err := json.Marshal(review)
+	if err != nil {
+		glog.Warningf("failed to encode admission review: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(data); err != nil {
+		glog.Warningf("failed to write admission review: %v", err)
+	}
+}